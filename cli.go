@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// command is a subcommand, most work without qBittorrent. A negative
+// number of arguments means the command parses its own options.
+type command struct {
+	usage string
+	args  int
+	run   func(ctx context.Context, cfg *config, args []string) error
+}
+
+var commands = map[string]*command{
+	"backfill": {
+		usage: "backfill [options]\tcheck completed torrents without a category, see backfill -h",
+		args:  -1,
+		run:   commandBackfill,
+	},
+	"scan": {
+		usage: "scan <path>\tlist archive sets with format and volume count",
+		args:  1,
+		run:   commandScan,
+	},
+	"test": {
+		usage: "test <path>\ttest the integrity of all archive sets",
+		args:  1,
+		run:   commandTest,
+	},
+	"unpack": {
+		usage: "unpack <path> <dest>\tunpack all archive sets to dest",
+		args:  2,
+		run:   commandUnpack,
+	},
+	"verify": {
+		usage: "verify <dest>\tverify unpacked files against their manifest",
+		args:  1,
+		run:   commandVerify,
+	},
+}
+
+// usage prints the command line help including the subcommands
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [options] [command]\n\nCommands:\n", os.Args[0])
+
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(tw, "  %s\n", commands[name].usage)
+	}
+	tw.Flush()
+
+	fmt.Fprintln(out, "\nOptions:")
+	flag.PrintDefaults()
+}
+
+// runCommand runs a subcommand and returns the process exit code. The
+// configuration file is optional, the defaults are used without it.
+func runCommand(cfg *config, path string, args []string) int {
+	cmd, ok := commands[args[0]]
+	if !ok || (cmd.args >= 0 && len(args)-1 != cmd.args) {
+		usage()
+		return 2
+	}
+
+	if err := cfg.loadConfig(path); err != nil && !os.IsNotExist(err) {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if err := cfg.validateSettings(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	if err := cmd.run(ctx, cfg, args[1:]); err == flag.ErrHelp {
+		return 2
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func commandScan(ctx context.Context, cfg *config, args []string) error {
+	up, err := NewUnpacker(cfg)
+	if err != nil {
+		return err
+	}
+
+	targets, err := up.ScanPath(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FORMAT\tVOLUMES\tPATH")
+	for _, target := range targets {
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", target.Format(), len(target.Volumes()), target.String())
+	}
+	return tw.Flush()
+}
+
+func commandTest(ctx context.Context, cfg *config, args []string) error {
+	up, err := NewUnpacker(cfg)
+	if err != nil {
+		return err
+	}
+
+	targets, err := up.ScanPath(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, target := range targets {
+		var out bytes.Buffer
+		if err := target.Test(ctx, &out); err == context.Canceled {
+			return err
+		} else if err != nil {
+			failed++
+			fmt.Printf("FAILED  %s; %s\n", target.String(), err.Error())
+			os.Stdout.Write(out.Bytes())
+		} else {
+			fmt.Printf("OK      %s\n", target.String())
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d archive sets failed the test", failed, len(targets))
+	}
+	return nil
+}
+
+func commandUnpack(ctx context.Context, cfg *config, args []string) error {
+	up, err := NewUnpacker(cfg)
+	if err != nil {
+		return err
+	}
+
+	targets, err := up.ScanPath(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	if len(targets) == 0 {
+		return fmt.Errorf("no archives found in %s", args[0])
+	}
+
+	logFile, err := openUnpackLog(args[1], false)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	report := newUnpackReport("", filepath.Base(args[0]), args[1])
+	return unpackTargets(ctx, cfg, targets, report, nil, logFile, "[Unpack]")
+}
+
+func commandVerify(ctx context.Context, cfg *config, args []string) error {
+	failed, err := verifyManifest(ctx, args[0], func(status, path string) {
+		fmt.Printf("%-8s%s\n", status, path)
+	})
+	if err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d files failed the verification", failed)
+	}
+	return nil
+}
+
+func commandBackfill(ctx context.Context, cfg *config, args []string) error {
+	fs := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	since := fs.String("since", "", "only torrents completed on or after this date (YYYY-MM-DD)")
+	before := fs.String("before", "", "only torrents completed before this date (YYYY-MM-DD)")
+	name := fs.String("name", "", "only torrents with a name matching this regular expression")
+	limit := fs.Int("limit", 0, "maximum number of torrents to check")
+	dryRun := fs.Bool("dry-run", false, "only list the torrents that would be checked")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var from, until time.Time
+	var err error
+	if len(*since) > 0 {
+		if from, err = time.ParseInLocation("2006-01-02", *since, time.Local); err != nil {
+			return fmt.Errorf("invalid -since date %s", *since)
+		}
+	}
+	if len(*before) > 0 {
+		if until, err = time.ParseInLocation("2006-01-02", *before, time.Local); err != nil {
+			return fmt.Errorf("invalid -before date %s", *before)
+		}
+	}
+
+	re, err := regexp.Compile(*name)
+	if err != nil {
+		return fmt.Errorf("invalid -name expression; %s", err.Error())
+	}
+
+	tc := NewTorrentClient(cfg.Server, cfg.Port, cfg.Username, cfg.Password)
+	torrents, err := tc.GetTorrents(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	// Completed torrents without a category, the oldest first
+	var selected []*Torrent
+	for _, t := range torrents {
+		completed := time.Unix(int64(t.CompletionOn), 0)
+		if !t.IsCompleted() || t.HasCategory() || !re.MatchString(t.Name) ||
+			(!from.IsZero() && completed.Before(from)) ||
+			(!until.IsZero() && !completed.Before(until)) {
+			continue
+		}
+		selected = append(selected, t)
+	}
+
+	sort.Slice(selected, func(i, j int) bool { return selected[i].CompletionOn < selected[j].CompletionOn })
+	if *limit > 0 && len(selected) > *limit {
+		selected = selected[:*limit]
+	}
+
+	if *dryRun {
+		for _, t := range selected {
+			fmt.Printf("%s  %s\n", time.Unix(int64(t.CompletionOn), 0).Format("2006-01-02"), t.Name)
+		}
+		return nil
+	}
+
+	up, err := NewUnpacker(cfg)
+	if err != nil {
+		return err
+	}
+
+	// Checks are recorded next to the ones of a running daemon
+	store, err := appendStateStore(cfg.StatePath)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	failed := 0
+	for _, t := range selected {
+		category, err := checkJob(ctx, cfg, up, store, t, "[Backfill]", func(category string, err error) error {
+			if err != nil {
+				return err
+			}
+			return tc.SetCategory(ctx, t.Hash, category)
+		})
+
+		if err == context.Canceled {
+			return err
+		} else if err != nil {
+			failed++
+			fmt.Printf("FAILED  %s; %s\n", t.Name, err.Error())
+		} else {
+			fmt.Printf("%s  %s\n", category, t.Name)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d torrents failed the check", failed, len(selected))
+	}
+	return nil
+}
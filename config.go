@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -24,19 +27,132 @@ type polling struct {
 }
 
 type workers struct {
-	Unpack uint `yaml:"unpack"`
-	Check  uint `yaml:"check"`
+	Unpack    uint          `yaml:"unpack"`
+	Check     uint          `yaml:"check"`
+	Nice      int           `yaml:"nice,omitempty"`
+	IOClass   int           `yaml:"ionice_class,omitempty"`
+	IOLevel   int           `yaml:"ionice_level,omitempty"`
+	Cgroup    string        `yaml:"cgroup,omitempty"`
+	CPUMax    string        `yaml:"cpu_max,omitempty"`
+	IOMax     []string      `yaml:"io_max,omitempty"`
+	Rate      uint64        `yaml:"rate,omitempty"`
+	Timeout   uint          `yaml:"timeout,omitempty"`
+	Stall     uint          `yaml:"stall,omitempty"`
+	Resume    string        `yaml:"resume"`
+	Drain     uint          `yaml:"drain,omitempty"`
+	PerDevice uint          `yaml:"per_device,omitempty"`
+	Devices   []deviceLimit `yaml:"devices,omitempty"`
+	devices   map[uint64]uint
+}
+
+// deviceLimit is the number of unpack jobs that may run at the same time
+// on the filesystem that holds a path
+type deviceLimit struct {
+	Path   string `yaml:"path"`
+	Unpack uint   `yaml:"unpack"`
+}
+
+// deviceLimit returns the limit of unpack jobs on a device, 0 is no limit
+func (w *workers) deviceLimit(dev uint64) uint {
+	if limit, ok := w.devices[dev]; ok {
+		return limit
+	}
+	return w.PerDevice
+}
+
+type scheduling struct {
+	Order       string   `yaml:"order"`
+	MaxWait     uint     `yaml:"max_wait,omitempty"`
+	Windows     []string `yaml:"windows,omitempty"`
+	MaxDownload uint64   `yaml:"max_download,omitempty"`
+	MaxLoad     float64  `yaml:"max_load,omitempty"`
+	windows     []*timeWindow
+}
+
+type throttling struct {
+	AltSpeed bool `yaml:"alt_speed"`
+	Pause    bool `yaml:"pause"`
+}
+
+type hooks struct {
+	Timeout    uint   `yaml:"timeout"`
+	PreCheck   string `yaml:"pre_check,omitempty"`
+	PostCheck  string `yaml:"post_check,omitempty"`
+	PreUnpack  string `yaml:"pre_unpack,omitempty"`
+	PostUnpack string `yaml:"post_unpack,omitempty"`
+}
+
+type retrying struct {
+	Attempts   uint     `yaml:"attempts"`
+	Backoff    uint     `yaml:"backoff"`
+	MaxBackoff uint     `yaml:"max_backoff"`
+	Errors     []string `yaml:"errors"`
+}
+
+type checking struct {
+	Test         bool `yaml:"test"`
+	AfterInstall bool `yaml:"after_install,omitempty"`
+	MaxAge       uint `yaml:"max_age,omitempty"`
+}
+
+type healing struct {
+	Attempts uint `yaml:"attempts"`
+}
+
+type sandboxing struct {
+	Landlock   bool `yaml:"landlock"`
+	Namespaces bool `yaml:"namespaces"`
+}
+
+type format struct {
+	Name        string   `yaml:"name"`
+	Ext         string   `yaml:"ext,omitempty"`
+	Magic       string   `yaml:"magic,omitempty"`
+	Command     string   `yaml:"command"`
+	Args        []string `yaml:"args"`
+	List        []string `yaml:"list,omitempty"`
+	Test        []string `yaml:"test,omitempty"`
+	Password    string   `yaml:"password,omitempty"`
+	Success     []int    `yaml:"success,omitempty"`
+	FirstVolume string   `yaml:"first_volume,omitempty"`
+}
+
+type rule struct {
+	Name     string   `yaml:"name"`
+	Action   string   `yaml:"action"`
+	Category string   `yaml:"category,omitempty"`
+	Tags     []string `yaml:"tags,omitempty"`
+	Tracker  string   `yaml:"tracker,omitempty"`
+	SavePath string   `yaml:"save_path,omitempty"`
+	Torrent  string   `yaml:"torrent,omitempty"`
+	MinSize  uint64   `yaml:"min_size,omitempty"`
+	MaxSize  uint64   `yaml:"max_size,omitempty"`
+	Archives *bool    `yaml:"archives,omitempty"`
 }
 
 type categories struct {
 	Default     string `yaml:"default"`
 	Error       string `yaml:"error"`
+	Corrupt     string `yaml:"corrupt"`
+	Canceled    string `yaml:"canceled"`
 	NoArchive   string `yaml:"no_archive"`
 	UnpackStart string `yaml:"unpack_start"`
 	UnpackBusy  string `yaml:"unpack_busy"`
 	UnpackDone  string `yaml:"unpack_done"`
 }
 
+type errorStates struct {
+	Tags          bool   `yaml:"tags"`
+	CRC           string `yaml:"crc"`
+	MissingVolume string `yaml:"missing_volume"`
+	Password      string `yaml:"password"`
+	DiskFull      string `yaml:"disk_full"`
+	Unsupported   string `yaml:"unsupported"`
+	Permission    string `yaml:"permission"`
+	Security      string `yaml:"security"`
+	Timeout       string `yaml:"timeout"`
+}
+
 type config struct {
 	Server      string       `yaml:"server"`
 	Port        uint16       `yaml:"port"`
@@ -45,11 +161,26 @@ type config struct {
 	DestPath    string       `yaml:"destpath"`
 	LogPath     string       `yaml:"logpath,omitempty"`
 	TempPath    string       `yaml:"temppath,omitempty"`
+	StatePath   string       `yaml:"statepath,omitempty"`
+	Watch       bool         `yaml:"watch,omitempty"`
+	Manifest    bool         `yaml:"manifest,omitempty"`
 	Permissions *permissions `yaml:"permissions,omitempty"`
 	Polling     polling      `yaml:"polling"`
 	Workers     workers      `yaml:"workers"`
+	Scheduler   scheduling   `yaml:"scheduler"`
+	Check       checking     `yaml:"check"`
+	Heal        healing      `yaml:"heal"`
+	Retry       retrying     `yaml:"retry"`
+	Throttle    throttling   `yaml:"throttle"`
+	Hooks       hooks        `yaml:"hooks"`
+	Sandbox     *sandboxing  `yaml:"sandbox,omitempty"`
+	Formats     []format     `yaml:"formats,omitempty"`
+	Rules       []rule       `yaml:"rules,omitempty"`
 	Categories  categories   `yaml:"categories"`
+	Errors      errorStates  `yaml:"errors"`
 	path        string
+	installed   time.Time
+	rules       []*ruleMatcher
 }
 
 func newConfig() *config {
@@ -63,16 +194,194 @@ func newConfig() *config {
 		Workers: workers{
 			Unpack: 1,
 			Check:  1,
+			Resume: resumeJob,
+		},
+		Scheduler: scheduling{
+			Order: orderFIFO,
+		},
+		Heal: healing{
+			Attempts: 1,
+		},
+		Retry: retrying{
+			Backoff:    5,
+			MaxBackoff: 240,
+			Errors:     []string{"disk_full", "permission", "timeout", "error"},
+		},
+		Hooks: hooks{
+			Timeout: 300,
 		},
 		Categories: categories{
 			Default:     "Completed",
 			Error:       "Error",
+			Corrupt:     "Corrupt",
+			Canceled:    "Canceled",
 			NoArchive:   "NoArchive",
 			UnpackStart: "Unpack",
 			UnpackBusy:  "Unpacking",
 			UnpackDone:  "Unpacked",
 		},
+		Errors: errorStates{
+			CRC:           "Error/CRC",
+			MissingVolume: "Error/MissingVolume",
+			Password:      "Error/Password",
+			DiskFull:      "Error/DiskFull",
+			Unsupported:   "Error/Unsupported",
+			Permission:    "Error/Permission",
+			Security:      "Error/Security",
+			Timeout:       "Error/Timeout",
+		},
+	}
+}
+
+// State returns the configured category or tag for a typed
+// error, or an empty string if the error has none
+func (e *errorStates) State(err error) string {
+	switch errorType(err) {
+	case "crc":
+		return e.CRC
+	case "missing_volume":
+		return e.MissingVolume
+	case "password":
+		return e.Password
+	case "disk_full":
+		return e.DiskFull
+	case "unsupported":
+		return e.Unsupported
+	case "permission":
+		return e.Permission
+	case "security":
+		return e.Security
+	case "timeout":
+		return e.Timeout
+	}
+
+	return ""
+}
+
+// All returns the configured states of all typed errors
+func (e *errorStates) All() []string {
+	var states []string
+	for _, s := range []string{e.CRC, e.MissingVolume, e.Password,
+		e.DiskFull, e.Unsupported, e.Permission, e.Security, e.Timeout} {
+		if len(s) > 0 {
+			states = append(states, s)
+		}
+	}
+	return states
+}
+
+// Retryable returns true if an unpack that failed with err may be retried
+func (r *retrying) Retryable(err error) bool {
+	kind := errorType(err)
+	for _, e := range r.Errors {
+		if e == kind {
+			return true
+		}
 	}
+	return false
+}
+
+// Delay returns the time to wait before retry n, which doubles with every
+// retry up to the maximum, if there is one
+func (r *retrying) Delay(n uint) time.Duration {
+	delay := time.Duration(r.Backoff) * time.Minute
+	max := time.Duration(r.MaxBackoff) * time.Minute
+	for i := uint(1); i < n && (max == 0 || delay < max); i++ {
+		delay *= 2
+	}
+	if max > 0 && delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// CheckCutoff returns the time before which completed torrents are not
+// checked automatically, or the zero time to check all of them
+func (cfg *config) CheckCutoff() time.Time {
+	var cutoff time.Time
+	if cfg.Check.AfterInstall {
+		cutoff = cfg.installed
+	}
+	if cfg.Check.MaxAge > 0 {
+		if age := time.Now().Add(-time.Duration(cfg.Check.MaxAge) * time.Hour); age.After(cutoff) {
+			cutoff = age
+		}
+	}
+	return cutoff
+}
+
+// CategoryNames returns all categories qbDaemon may give a torrent
+func (cfg *config) CategoryNames() []string {
+	names := []string{cfg.Categories.Default, cfg.Categories.Error,
+		cfg.Categories.NoArchive, cfg.Categories.UnpackBusy,
+		cfg.Categories.UnpackDone, cfg.Categories.UnpackStart,
+		cfg.Categories.Canceled}
+	if cfg.Check.Test {
+		names = append(names, cfg.Categories.Corrupt)
+	}
+	if !cfg.Errors.Tags {
+		names = append(names, cfg.Errors.All()...)
+	}
+	return names
+}
+
+// reloaded returns a copy of the configuration with the settings of next
+// that can change while running, and the keys of the changed settings
+// that need a restart. The configuration itself is left as is, as it is
+// read without a lock.
+func (cfg *config) reloaded(next *config) (*config, []string) {
+	var restart []string
+	check := func(key string, changed bool) {
+		if changed {
+			restart = append(restart, key)
+		}
+	}
+
+	check("server", cfg.Server != next.Server || cfg.Port != next.Port)
+	check("username", cfg.Username != next.Username || cfg.Password != next.Password)
+	check("destpath", cfg.DestPath != next.DestPath)
+	check("temppath", cfg.TempPath != next.TempPath)
+	check("logpath", cfg.LogPath != next.LogPath)
+	check("statepath", cfg.StatePath != next.StatePath)
+	check("workers", cfg.Workers.Nice != next.Workers.Nice ||
+		cfg.Workers.IOClass != next.Workers.IOClass ||
+		cfg.Workers.IOLevel != next.Workers.IOLevel ||
+		cfg.Workers.Cgroup != next.Workers.Cgroup ||
+		cfg.Workers.CPUMax != next.Workers.CPUMax ||
+		!reflect.DeepEqual(cfg.Workers.IOMax, next.Workers.IOMax) ||
+		cfg.Workers.Rate != next.Workers.Rate)
+	check("sandbox", !reflect.DeepEqual(cfg.Sandbox, next.Sandbox))
+	check("formats", !reflect.DeepEqual(cfg.Formats, next.Formats))
+	check("watch", cfg.Watch != next.Watch)
+
+	// Running jobs are canceled when their torrent leaves the busy category
+	check("categories", cfg.Categories != next.Categories)
+
+	merged := *cfg
+	cfg = &merged
+	cfg.Permissions = next.Permissions
+	cfg.Manifest = next.Manifest
+	cfg.Polling = next.Polling
+	cfg.Workers.Unpack = next.Workers.Unpack
+	cfg.Workers.Check = next.Workers.Check
+	cfg.Workers.Timeout = next.Workers.Timeout
+	cfg.Workers.Stall = next.Workers.Stall
+	cfg.Workers.Resume = next.Workers.Resume
+	cfg.Workers.Drain = next.Workers.Drain
+	cfg.Workers.PerDevice = next.Workers.PerDevice
+	cfg.Workers.Devices = next.Workers.Devices
+	cfg.Workers.devices = next.Workers.devices
+	cfg.Scheduler = next.Scheduler
+	cfg.Check = next.Check
+	cfg.Heal = next.Heal
+	cfg.Retry = next.Retry
+	cfg.Throttle = next.Throttle
+	cfg.Hooks = next.Hooks
+	cfg.Rules = next.Rules
+	cfg.rules = next.rules
+	cfg.Errors = next.Errors
+
+	return cfg, restart
 }
 
 func (cfg *config) HasUser() bool {
@@ -160,5 +469,115 @@ func (cfg *config) Validate() error {
 		}
 	}
 
+	// Check 'statepath' if it's set
+	if len(cfg.StatePath) > 0 {
+		if err := checkDir("statepath", cfg.StatePath); err != nil {
+			return err
+		}
+	}
+
+	// Find the devices of the paths with their own unpack limit
+	cfg.Workers.devices = make(map[uint64]uint)
+	for _, dl := range cfg.Workers.Devices {
+		if dl.Unpack == 0 {
+			return fmt.Errorf("workers device %s needs an 'unpack' limit of at least 1", dl.Path)
+		}
+		if _, err := os.Stat(dl.Path); err != nil {
+			return err
+		}
+		dev, ok := deviceOf(dl.Path)
+		if !ok {
+			return fmt.Errorf("workers device %s has no device number", dl.Path)
+		}
+		cfg.Workers.devices[dev] = dl.Unpack
+	}
+
+	return cfg.validateSettings()
+}
+
+// validateSettings checks everything in the config except the paths
+func (cfg *config) validateSettings() error {
+
+	// Check the scheduling settings of the workers
+	if cfg.Workers.Nice < -20 || cfg.Workers.Nice > 19 {
+		return fmt.Errorf("workers 'nice' must be between -20 and 19")
+	}
+
+	if cfg.Workers.IOClass < 0 || cfg.Workers.IOClass > 3 {
+		return fmt.Errorf("workers 'ionice_class' must be between 0 and 3")
+	}
+
+	if cfg.Workers.IOLevel < 0 || cfg.Workers.IOLevel > 7 {
+		return fmt.Errorf("workers 'ionice_level' must be between 0 and 7")
+	}
+
+	if cfg.Workers.Resume != resumeJob && cfg.Workers.Resume != resetJob {
+		return fmt.Errorf("workers 'resume' must be %s or %s", resumeJob, resetJob)
+	}
+
+	// The first start is only known with a state path to keep it in
+	if cfg.Check.AfterInstall && len(cfg.StatePath) == 0 {
+		return fmt.Errorf("check 'after_install' needs a 'statepath' to keep the time of the first start in")
+	}
+
+	switch cfg.Scheduler.Order {
+	case orderFIFO, orderSmallest, orderOldest:
+	default:
+		return fmt.Errorf("scheduler 'order' must be %s, %s or %s", orderFIFO, orderSmallest, orderOldest)
+	}
+
+	// Check the windows in which unpack jobs may start
+	cfg.Scheduler.windows = nil
+	for _, s := range cfg.Scheduler.Windows {
+		w, err := parseWindow(s)
+		if err != nil {
+			return err
+		}
+		cfg.Scheduler.windows = append(cfg.Scheduler.windows, w)
+	}
+
+	// Check the hook scripts
+	for _, hook := range []string{hookPreCheck, hookPostCheck, hookPreUnpack, hookPostUnpack} {
+		if command := cfg.Hooks.command(hook); len(command) > 0 {
+			if _, err := exec.LookPath(command); err != nil {
+				return fmt.Errorf("hooks '%s' can't be run; %s", hook, err.Error())
+			}
+		}
+	}
+
+	if cfg.Scheduler.MaxLoad > 0 {
+		if _, err := loadAverage(); err != nil {
+			return fmt.Errorf("scheduler 'max_load' can't be used; %s", err.Error())
+		}
+	}
+
+	// Check the error types that can be retried
+	for _, e := range cfg.Retry.Errors {
+		known := false
+		for _, kind := range errorTypes {
+			known = known || e == kind
+		}
+		if !known {
+			return fmt.Errorf("retry 'errors' has an unknown error type %s", e)
+		}
+	}
+
+	// Check the user defined formats
+	for i := range cfg.Formats {
+		if _, err := newCustomFormat(&cfg.Formats[i], nil, nil); err != nil {
+			return err
+		}
+	}
+
+	// Check and compile the rules
+	cfg.rules = nil
+	for i := range cfg.Rules {
+		rm, err := newRule(&cfg.Rules[i])
+		if err != nil {
+			return err
+		}
+		cfg.rules = append(cfg.rules, rm)
+	}
+
 	return nil
 }
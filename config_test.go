@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		backoff    uint
+		maxBackoff uint
+		delays     []time.Duration // in minutes, from the first retry
+	}{
+		{5, 0, []time.Duration{5, 10, 20, 40, 80}},
+		{5, 30, []time.Duration{5, 10, 20, 30, 30, 30}},
+		{5, 20, []time.Duration{5, 10, 20, 20}},
+		{10, 5, []time.Duration{5, 5}},
+		{1, 1, []time.Duration{1, 1}},
+		{0, 0, []time.Duration{0, 0, 0}},
+		{0, 30, []time.Duration{0, 0, 0}},
+	}
+
+	for _, test := range tests {
+		r := &retrying{Backoff: test.backoff, MaxBackoff: test.maxBackoff}
+		for i, want := range test.delays {
+			n := uint(i + 1)
+			if got := r.Delay(n); got != want*time.Minute {
+				t.Errorf("backoff %d, max %d: Delay(%d) = %s, want %s",
+					test.backoff, test.maxBackoff, n, got, want*time.Minute)
+			}
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	r := &retrying{Errors: []string{"disk_full", "error"}}
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{ErrDiskFull, true},
+		{fmt.Errorf("unpacking a.rar: %w", ErrDiskFull), true},
+		{fmt.Errorf("something failed"), true},
+		{ErrCRC, false},
+		{&SecurityError{Path: "../a", Reason: "parent directory reference"}, false},
+	}
+
+	for _, test := range tests {
+		if got := r.Retryable(test.err); got != test.want {
+			t.Errorf("Retryable(%v) = %t, want %t", test.err, got, test.want)
+		}
+	}
+}
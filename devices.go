@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// deviceOf returns the device of the filesystem that holds path, or of
+// its closest parent that exists
+func deviceOf(path string) (uint64, bool) {
+	for {
+		if info, err := os.Stat(path); err == nil {
+			if key, _, ok := fileInode(info); ok {
+				return key.dev, true
+			}
+			return 0, false
+		}
+
+		parent := filepath.Dir(path)
+		if parent == path {
+			return 0, false
+		}
+		path = parent
+	}
+}
+
+// deviceSlots counts the running unpack jobs on each device, so the jobs
+// on one device don't have to wait for the jobs on another
+type deviceSlots struct {
+	running map[uint64]uint
+	held    map[string][]uint64
+}
+
+func newDeviceSlots() *deviceSlots {
+	return &deviceSlots{
+		running: make(map[uint64]uint),
+		held:    make(map[string][]uint64),
+	}
+}
+
+// jobDevices returns the devices an unpack job reads from and writes to
+func jobDevices(cfg *config, t *Torrent) []uint64 {
+	var devices []uint64
+	for _, path := range []string{t.SavePath, cfg.DestPath} {
+		dev, ok := deviceOf(path)
+		if !ok || (len(devices) > 0 && devices[0] == dev) {
+			continue
+		}
+		devices = append(devices, dev)
+	}
+	return devices
+}
+
+// free returns true if none of the devices is at its limit
+func (ds *deviceSlots) free(cfg *config, devices []uint64) bool {
+	for _, dev := range devices {
+		if limit := cfg.Workers.deviceLimit(dev); limit > 0 && ds.running[dev] >= limit {
+			return false
+		}
+	}
+	return true
+}
+
+// acquire takes a slot on the devices of a job
+func (ds *deviceSlots) acquire(hash string, devices []uint64) {
+	for _, dev := range devices {
+		ds.running[dev]++
+	}
+	ds.held[hash] = devices
+}
+
+// release frees the slots of a job, and returns true if it had any
+func (ds *deviceSlots) release(hash string) bool {
+	devices, ok := ds.held[hash]
+	if !ok {
+		return false
+	}
+	for _, dev := range devices {
+		if ds.running[dev]--; ds.running[dev] == 0 {
+			delete(ds.running, dev)
+		}
+	}
+	delete(ds.held, hash)
+	return true
+}
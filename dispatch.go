@@ -1,11 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,6 +26,23 @@ type AddCategory struct {
 	category string
 }
 
+// AddTags ...
+type AddTags struct {
+	hash string
+	tags string
+}
+
+// RemoveTags ...
+type RemoveTags struct {
+	hash string
+	tags string
+}
+
+// Recheck ...
+type Recheck struct {
+	hash string
+}
+
 // GetTorrents ...
 type GetTorrents struct{}
 
@@ -28,29 +51,64 @@ type DeQueue struct {
 	hash string
 }
 
+// Reload ...
+type Reload struct {
+	cfg *config
+}
+
+// workerPool keeps a quit channel for every running worker of a type
+type workerPool struct {
+	quit []chan struct{}
+}
+
 // Dispatcher ...
 type Dispatcher struct {
 	wg       *sync.WaitGroup
-	cfg      *config
+	conf     *atomic.Pointer[config]
 	up       *Unpacker
+	store    *stateStore
 	result   chan error
 	timer    *time.Timer
 	timeouts int
 	actions  chan interface{}
 	done     chan interface{}
 	tm       *TorrentQueue
+	jobs     context.Context
+	stopJobs context.CancelFunc
+	stopFeed context.CancelFunc
+	feed     context.Context
+	unpack   *workerPool
+	check    *workerPool
+	limiter  *throttler
 }
 
 // NewDispatcher ...
-func NewDispatcher(cfg *config, up *Unpacker) *Dispatcher {
+func NewDispatcher(cfg *config, up *Unpacker, store *stateStore) *Dispatcher {
+
+	// The workers and the feeding of jobs to them are stopped separately
+	// from Run, so running jobs can finish while the dispatcher shuts down
+	jobs, stopJobs := context.WithCancel(context.Background())
+	feed, stopFeed := context.WithCancel(jobs)
+
+	conf := &atomic.Pointer[config]{}
+	conf.Store(cfg)
+
 	return &Dispatcher{
-		wg:      &sync.WaitGroup{},
-		cfg:     cfg,
-		up:      up,
-		result:  make(chan error),
-		actions: make(chan interface{}, 100),
-		tm:      NewTorrentQueue(cfg),
-		done:    make(chan interface{}),
+		wg:       &sync.WaitGroup{},
+		conf:     conf,
+		up:       up,
+		store:    store,
+		result:   make(chan error),
+		actions:  make(chan interface{}, 100),
+		tm:       NewTorrentQueue(cfg, store),
+		done:     make(chan interface{}),
+		jobs:     jobs,
+		stopJobs: stopJobs,
+		feed:     feed,
+		stopFeed: stopFeed,
+		unpack:   &workerPool{},
+		check:    &workerPool{},
+		limiter:  newThrottler(cfg.StatePath),
 	}
 }
 
@@ -78,10 +136,10 @@ func (d *Dispatcher) resetTimeout() {
 func (d *Dispatcher) resetTimer() {
 	if d.timer == nil {
 		d.timer = time.AfterFunc(
-			time.Duration(d.cfg.Polling.Delay)*time.Second,
+			time.Duration(d.cfg().Polling.Delay)*time.Second,
 			func() { d.actions <- GetTorrents{} })
 	} else {
-		d.timer.Reset(time.Duration(d.cfg.Polling.Delay) * time.Second)
+		d.timer.Reset(time.Duration(d.cfg().Polling.Delay) * time.Second)
 	}
 
 }
@@ -111,11 +169,292 @@ func (d *Dispatcher) waitGroupLeave() {
 	d.wg.Done()
 }
 
+// Shutdown stops starting new jobs and gives the running jobs the drain
+// time to finish. Jobs still running after it are stopped and left in a
+// state they can be resumed from. It returns when all workers are done.
+func (d *Dispatcher) Shutdown(drain time.Duration) {
+	d.stopFeed()
+
+	if n := d.tm.Running(); n > 0 && drain > 0 {
+		log.Printf("[Manager] Waiting up to %s for %d running jobs to finish", drain, n)
+
+		ticker := time.NewTicker(time.Second)
+		deadline := time.NewTimer(drain)
+	wait:
+		for d.tm.Running() > 0 {
+			select {
+			case <-ticker.C:
+			case <-deadline.C:
+				break wait
+			case <-d.jobs.Done():
+				break wait
+			}
+		}
+		ticker.Stop()
+		deadline.Stop()
+	}
+
+	if n := d.tm.Running(); n > 0 {
+		log.Printf("[Manager] Stopping %d running jobs", n)
+	}
+
+	d.stopJobs()
+	d.wg.Wait()
+}
+
+// StopJobs stops all running jobs right away
+func (d *Dispatcher) StopJobs() {
+	d.stopJobs()
+}
+
+// suspend leaves a torrent whose unpack was stopped by a shutdown in a
+// state it can be resumed from on the next start
+func (d *Dispatcher) suspend(t *Torrent, prefix string) {
+	if d.cfg().Workers.Resume == resetJob {
+		log.Printf("%s Unpacking of %s (%s) was stopped, it will start over", prefix, t.Hash, t.Name)
+		d.actions <- SetCategory{
+			hash:     t.Hash,
+			category: d.cfg().Categories.UnpackStart,
+		}
+	} else {
+		log.Printf("%s Unpacking of %s (%s) was stopped, it will be resumed", prefix, t.Hash, t.Name)
+	}
+}
+
+// flush performs the actions that are left when Run stops
+func (d *Dispatcher) flush(tc *QbClient) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Duration(d.cfg().Polling.Timeout)*time.Second)
+	defer cancel()
+
+	for {
+		select {
+		case actionType := <-d.actions:
+			if _, ok := actionType.(GetTorrents); ok {
+				continue
+			}
+			if err := d.perform(ctx, tc, actionType); err != nil {
+				log.Printf("[Manager] Failed to perform %T on shutdown; %s", actionType, err.Error())
+			}
+		default:
+			return
+		}
+	}
+}
+
+// cfg returns the current configuration, which is replaced as a whole
+// when it is reloaded
+func (d *Dispatcher) cfg() *config {
+	return d.conf.Load()
+}
+
+// Reload applies a new validated configuration while running
+func (d *Dispatcher) Reload(cfg *config) {
+	d.actions <- Reload{cfg: cfg}
+}
+
+// resize starts or stops workers until the pool has n of them. Stopped
+// workers finish their current job first.
+func (d *Dispatcher) resize(pool *workerPool, n uint, start func(w uint, quit <-chan struct{})) {
+	for uint(len(pool.quit)) < n {
+		quit := make(chan struct{})
+		start(uint(len(pool.quit)), quit)
+		pool.quit = append(pool.quit, quit)
+	}
+	for uint(len(pool.quit)) > n {
+		last := len(pool.quit) - 1
+		close(pool.quit[last])
+		pool.quit = pool.quit[:last]
+	}
+}
+
+// startWorkers sizes the worker pools to the configuration. Workers are
+// added to the wait group before they start, so Shutdown waits for them.
+func (d *Dispatcher) startWorkers() {
+	d.resize(d.unpack, d.cfg().Workers.Unpack, func(w uint, quit <-chan struct{}) {
+		d.waitGroupEnter()
+		go d.workerUnpack(d.jobs, w, d.tm.QueueA(), quit)
+	})
+	d.resize(d.check, d.cfg().Workers.Check, func(w uint, quit <-chan struct{}) {
+		d.waitGroupEnter()
+		go d.workerCheck(d.jobs, w, d.tm.QueueB(), quit)
+	})
+}
+
+// reload takes over a new configuration and applies the changes to the
+// workers, the categories and the polling timer
+func (d *Dispatcher) reload(ctx context.Context, tc *QbClient, next *config) error {
+	known := make(map[string]bool)
+	for _, category := range d.cfg().CategoryNames() {
+		known[category] = true
+	}
+
+	cfg, restart := d.cfg().reloaded(next)
+	for _, key := range restart {
+		log.Printf("[Manager] Changes to '%s' need a restart to take effect", key)
+	}
+
+	// Readers see either the old or the new configuration
+	d.conf.Store(cfg)
+	d.tm.SetConfig(cfg)
+
+	d.startWorkers()
+
+	for _, category := range cfg.CategoryNames() {
+		if !known[category] {
+			if err := d.perform(ctx, tc, AddCategory{category: category}); err != nil {
+				return err
+			}
+		}
+	}
+
+	d.resetTimer()
+	log.Printf("[Manager] Configuration reloaded, running with %d workers", cfg.Workers.Check+cfg.Workers.Unpack)
+	return nil
+}
+
 // QueueAction ...
 func (d *Dispatcher) QueueAction(a interface{}) {
 	d.actions <- a
 }
 
+// setError sets the error state of a torrent. Typed errors get their
+// configured category, or the error category and their configured tag.
+func (d *Dispatcher) setError(hash string, err error) {
+	d.actions <- SetCategory{
+		hash:     hash,
+		category: errorCategory(d.cfg(), err),
+	}
+	if state := d.cfg().Errors.State(err); len(state) > 0 && d.cfg().Errors.Tags {
+		d.actions <- AddTags{hash: hash, tags: state}
+	}
+}
+
+// heal starts a recheck attempt for errors caused by corrupt data, it
+// returns the attempt number or zero if the error can't be healed
+func (d *Dispatcher) heal(err error, hash string) uint {
+	if !errors.Is(err, ErrCRC) && !errors.Is(err, ErrMissingVolume) {
+		return 0
+	}
+	return d.tm.Heal(hash)
+}
+
+// record saves a change to the job record of a torrent
+func (d *Dispatcher) record(t *Torrent, fn func(rec *jobRecord)) {
+	recordJob(d.store, t, fn)
+}
+
+// recordJob saves a change to the job record of a torrent in a store
+func recordJob(store *stateStore, t *Torrent, fn func(rec *jobRecord)) {
+	if err := store.Update(t, fn); err != nil {
+		log.Printf("[State] Error saving the state of torrent %s; %s", t.Hash, err.Error())
+	}
+}
+
+// prune forgets the state of torrents that were removed from qBittorrent
+func (d *Dispatcher) prune(torrents []*Torrent) {
+	pruned, err := d.store.Prune(torrents)
+	for _, hash := range pruned {
+		log.Printf("[State] Removed the state of torrent %s, it is no longer in qBittorrent", hash)
+	}
+	if err != nil {
+		log.Printf("[State] Error removing the state of removed torrents; %s", err.Error())
+	}
+}
+
+// recordResult saves the outcome of a job in the record of a torrent
+func (d *Dispatcher) recordResult(t *Torrent, status, category string, err error) {
+	d.record(t, func(rec *jobRecord) {
+		rec.setResult(status, category, err)
+		rec.Retries, rec.RetryAt = d.tm.Retries(t.Hash)
+		rec.Heals = d.tm.Heals(t.Hash)
+	})
+}
+
+// finishUnpack saves the outcome of an unpack job and runs the post_unpack
+// hook. Failures without a category get the category of their error.
+func (d *Dispatcher) finishUnpack(t *Torrent, destPath string, status, category string, err error, prefix string) {
+	d.recordResult(t, status, category, err)
+
+	if len(category) == 0 && err != nil {
+		category = errorCategory(d.cfg(), err)
+	}
+	d.runUnpackHook(hookPostUnpack, &hookJob{
+		torrent:  t,
+		category: category,
+		dest:     destPath,
+		result:   status,
+		err:      err,
+	}, prefix)
+}
+
+// cancelUnpack handles an unpack job that was canceled from qBittorrent.
+// What the job extracted is removed. A torrent tagged to cancel gets the
+// canceled category, a torrent that was moved to another category by
+// hand keeps it. The output of a torrent that was removed from
+// qBittorrent is kept, so the job resumes if it shows up again.
+func (d *Dispatcher) cancelUnpack(t *Torrent, destPath string, report *unpackReport, prefix string) {
+	current := d.tm.Get(t.Hash)
+	if current == nil {
+		log.Printf("%s Unpacking of %s (%s) was canceled, it was removed from qBittorrent", prefix, t.Hash, t.Name)
+		d.finishUnpack(t, destPath, jobCanceled, "", nil, prefix)
+		return
+	}
+
+	log.Printf("%s Unpacking of %s (%s) was canceled, removing the partial output", prefix, t.Hash, t.Name)
+	if err := removeCreated(destPath, report.created()); err != nil {
+		log.Printf("%s Error cleaning up '%s'; %s", prefix, destPath, err.Error())
+	}
+
+	category := current.Category
+	if current.HasTag(tagCancel) {
+		category = d.cfg().Categories.Canceled
+		d.actions <- SetCategory{
+			hash:     t.Hash,
+			category: category,
+		}
+		d.actions <- RemoveTags{hash: t.Hash, tags: tagCancel}
+	}
+	d.finishUnpack(t, destPath, jobCanceled, category, nil, prefix)
+}
+
+// retry schedules another attempt for unpack errors that can be retried,
+// it returns the attempt number and delay or zero if it can't be retried
+func (d *Dispatcher) retry(err error, hash string) (uint, time.Duration) {
+	if !d.cfg().Retry.Retryable(err) {
+		return 0, 0
+	}
+	return d.tm.Retry(hash)
+}
+
+// decide applies the rules to a checked torrent and returns its category,
+// which is the unpack start category when a rule says to unpack it
+func decide(cfg *config, t *Torrent, category string, prefix string) string {
+	if len(cfg.rules) == 0 {
+		return category
+	}
+
+	action, reason := applyRules(cfg.rules, t, category, category != cfg.Categories.NoArchive)
+	switch {
+	case action == ruleUnpack && category == cfg.Categories.Default:
+		log.Printf("%s Queueing torrent %s (%s) for unpacking, %s", prefix, t.Hash, t.Name, reason)
+		return cfg.Categories.UnpackStart
+	case action == ruleUnpack:
+		log.Printf("%s Not unpacking torrent %s (%s) with category %s, %s", prefix, t.Hash, t.Name, category, reason)
+	case action == ruleSkip:
+		log.Printf("%s Skipping torrent %s (%s), %s", prefix, t.Hash, t.Name, reason)
+	default:
+		log.Printf("%s Not unpacking torrent %s (%s), %s", prefix, t.Hash, t.Name, reason)
+	}
+	return category
+}
+
+// clearErrorTags removes the error tags left by a previous attempt
+func (d *Dispatcher) clearErrorTags(hash string) {
+	if d.cfg().Errors.Tags {
+		d.actions <- RemoveTags{hash: hash, tags: strings.Join(d.cfg().Errors.All(), ",")}
+	}
+}
+
 func setPermissions(path string, cfg *config) error {
 	var errno error
 	if cfg.Permissions != nil {
@@ -142,8 +481,101 @@ func setPermissions(path string, cfg *config) error {
 	return errno
 }
 
-func (d *Dispatcher) workerUnpack(ctx context.Context, w uint, jobs <-chan TorrentJob) {
-	d.waitGroupEnter()
+// openUnpackLog creates the destination and the unpack.log file in it.
+// A resumed job appends to the log of the job it continues.
+func openUnpackLog(destPath string, resume bool) (*os.File, error) {
+	if err := os.MkdirAll(destPath, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if resume {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+
+	logPath := filepath.Join(destPath, unpackLogName)
+	return os.OpenFile(logPath, flags, 0644)
+}
+
+// removeCreated removes the entries a canceled job created from the
+// destination, everything else in it is left alone
+func removeCreated(destPath string, paths []string) error {
+	for _, rel := range paths {
+		if err := os.RemoveAll(filepath.Join(destPath, rel)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unpackTargets unpacks all targets into destPath, writes the manifest when
+// it's enabled and sets the file permissions. Every target is tried and the
+// first error is returned, except when canceled or after a security
+// violation. The results are recorded in the report, which is written to
+// unpack.json. Targets found in the journal are skipped, unpacked ones are
+// added to it.
+func unpackTargets(ctx context.Context, cfg *config, targets []*Target,
+	report *unpackReport, jr *journal, logFile io.Writer, prefix string) error {
+
+	destPath := report.Dest
+
+	var unpackErr error
+	for _, target := range targets {
+		if jr.Done(target) {
+			log.Printf("%s Skipping target %s, it was already unpacked", prefix, target.String())
+			continue
+		}
+
+		start := time.Now()
+		ex, err := unpackTarget(ctx, cfg, target, destPath+string(filepath.Separator), logFile)
+		report.addTarget(target, start, ex, err)
+		if err == context.Canceled {
+			return err
+		}
+
+		if err == nil {
+			if err := jr.Finish(target); err != nil {
+				log.Printf("%s Error writing %s; %s", prefix, unpackJournalName, err.Error())
+			}
+		} else {
+			log.Printf("%s Error unpacking target %s; %s", prefix, target.String(), err.Error())
+			if unpackErr == nil {
+				unpackErr = err
+			}
+
+			// Don't touch the remaining targets of a hostile torrent
+			if _, ok := err.(*SecurityError); ok {
+				break
+			}
+		}
+	}
+
+	// Only a complete unpack gets a manifest to verify it against later,
+	// of the files this run extracted. Without one the job still succeeded.
+	if unpackErr == nil && cfg.Manifest {
+		if err := writeManifest(ctx, destPath, report.created()); err == context.Canceled {
+			return err
+		} else if err != nil {
+			log.Printf("%s Error writing %s; %s", prefix, unpackManifestName, err.Error())
+		}
+	}
+
+	if err := setPermissions(destPath, cfg); err != nil {
+		log.Printf("%s Error setting file permissions; %s", prefix, err.Error())
+		if unpackErr == nil {
+			unpackErr = err
+		}
+	}
+
+	report.finish(unpackErr)
+	if err := report.write(); err != nil {
+		log.Printf("%s Error writing %s; %s", prefix, unpackReportName, err.Error())
+	}
+
+	return unpackErr
+}
+
+func (d *Dispatcher) workerUnpack(ctx context.Context, w uint, jobs <-chan TorrentJob, quit <-chan struct{}) {
 	defer d.waitGroupLeave()
 
 	for {
@@ -151,148 +583,437 @@ func (d *Dispatcher) workerUnpack(ctx context.Context, w uint, jobs <-chan Torre
 		case job := <-jobs:
 
 			torrent := job.GetTorrent()
+			cfg := d.cfg()
 			scanPath := filepath.Join(torrent.SavePath, torrent.Name)
-			log.Printf("[Unpack/%d] Unpacking %s (%s)", w, torrent.Hash, torrent.Name)
+			destPath := filepath.Join(cfg.DestPath, torrent.Name)
+			prefix := fmt.Sprintf("[Unpack/%d]", w)
+
+			resume := false
+			if unpack, ok := job.(*UnpackTorrent); ok {
+				resume = unpack.resume
+			}
+
+			if resume && cfg.Workers.Resume == resetJob {
+				// Interrupted job; start over by unpacking all targets again
+				log.Printf("[Unpack/%d] Resetting interrupted unpack of %s (%s)", w, torrent.Hash, torrent.Name)
+				os.Remove(filepath.Join(destPath, unpackJournalName))
+
+				d.actions <- SetCategory{
+					hash:     torrent.Hash,
+					category: cfg.Categories.UnpackStart,
+				}
+				d.tm.JobDone(torrent.Hash)
+				continue
+			} else if resume {
+				log.Printf("[Unpack/%d] Resuming interrupted unpack of %s (%s)", w, torrent.Hash, torrent.Name)
+			} else if retries, _ := d.tm.Retries(torrent.Hash); retries > 0 {
+				log.Printf("[Unpack/%d] Unpacking %s (%s), attempt %d of %d",
+					w, torrent.Hash, torrent.Name, retries+1, cfg.Retry.Attempts+1)
+			} else {
+				log.Printf("[Unpack/%d] Unpacking %s (%s)", w, torrent.Hash, torrent.Name)
+			}
+
+			// The job has its own context, to cancel it from qBittorrent
+			jctx := d.tm.JobContext(ctx, torrent.Hash)
 
 			// Scan the path for targets to unpack
-			targets, err := d.up.ScanPath(ctx, scanPath)
-			if err == context.Canceled {
+			targets, err := d.up.ScanPath(jctx, scanPath)
+			if err == context.Canceled && ctx.Err() != nil {
 				// When canceled it means we just exit because we're shutting down
 				return
+			} else if err == context.Canceled {
+				log.Printf("[Unpack/%d] Unpacking of %s (%s) was canceled", w, torrent.Hash, torrent.Name)
+				d.finishUnpack(torrent, destPath, jobCanceled, "", nil, prefix)
 			} else if err != nil {
 				// Some other error occurred, log the issue and set the category to error
 				log.Printf("[Unpack/%d] Error scanning path for torrent %s (%s); %s",
 					w, torrent.Hash, scanPath, err.Error())
 
-				d.actions <- SetCategory{
-					hash:     torrent.Hash,
-					category: d.cfg.Categories.Error,
-				}
+				d.setError(torrent.Hash, err)
+				d.finishUnpack(torrent, destPath, jobFailed, "", err, prefix)
 
 			} else {
 				if len(targets) == 0 {
 					// No targets; set the category to NoArchive
 					d.actions <- SetCategory{
 						hash:     torrent.Hash,
-						category: d.cfg.Categories.NoArchive,
+						category: cfg.Categories.NoArchive,
 					}
+					d.finishUnpack(torrent, destPath, jobUnpacked, cfg.Categories.NoArchive, nil, prefix)
 				} else {
-					// We have targets to unpack, open a log file
-					unpackError := false
-					destPath := filepath.Join(d.cfg.DestPath, torrent.Name)
-					os.MkdirAll(destPath, os.ModePerm)
-					logPath := filepath.Join(destPath, "unpack.log")
-					logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+					// We have targets to unpack, open a log file and the journal
+					var jr *journal
+					var report *unpackReport
+					logFile, err := openUnpackLog(destPath, resume)
 					if err != nil {
 						// Some other error occurred, log the issue and set the category to error
-						log.Printf("[Unpack/%d] Error opening logfile '%s' path for torrent %s (%s); %s",
-							w, logPath, torrent.Hash, torrent.Name, err.Error())
-
-						d.actions <- SetCategory{
-							hash:     torrent.Hash,
-							category: d.cfg.Categories.Error,
-						}
+						log.Printf("[Unpack/%d] Error opening logfile in '%s' for torrent %s (%s); %s",
+							w, destPath, torrent.Hash, torrent.Name, err.Error())
+					} else if jr, err = openJournal(destPath, resume); err != nil {
+						logFile.Close()
+						log.Printf("[Unpack/%d] Error opening %s in '%s' for torrent %s (%s); %s",
+							w, unpackJournalName, destPath, torrent.Hash, torrent.Name, err.Error())
 					} else {
 
 						d.actions <- SetCategory{
 							hash:     torrent.Hash,
-							category: d.cfg.Categories.UnpackBusy,
+							category: cfg.Categories.UnpackBusy,
 						}
-
-						for _, target := range targets {
-							err = target.Unpack(ctx, destPath+string(filepath.Separator), logFile)
-							if err == context.Canceled {
-								// When canceled it means we just exit because we're shutting down
-								logFile.Close()
-								return
-							}
-
-							if err != nil {
-								unpackError = true
-								log.Printf("[Unpack/%d] Error unpacking target %s; %s",
-									w, target.String(), err.Error())
-							}
+						d.clearErrorTags(torrent.Hash)
+						d.record(torrent, func(rec *jobRecord) {
+							rec.Status = jobUnpacking
+							rec.Category = cfg.Categories.UnpackBusy
+							rec.Attempts++
+							rec.Dest = destPath
+							rec.Started = time.Now()
+						})
+						if cfg.Throttle.AltSpeed || cfg.Throttle.Pause {
+							d.actions <- Throttle{hash: torrent.Hash}
 						}
+						runHook(d.jobs, cfg, hookPreUnpack, &hookJob{
+							torrent:  torrent,
+							category: cfg.Categories.UnpackBusy,
+							dest:     destPath,
+						}, logFile, prefix)
+
+						report = newUnpackReport(torrent.Hash, torrent.Name, destPath)
+						retries, _ := d.tm.Retries(torrent.Hash)
+						report.Attempt = retries + 1
+						err = unpackTargets(jctx, cfg, targets, report, jr, logFile, prefix)
+						logFile.Close()
+						d.actions <- Unthrottle{hash: torrent.Hash}
 
-						err = setPermissions(destPath, d.cfg)
-						if err != nil {
-							log.Printf("[Unpack/%d] Error setting file permissions; %s", w, err.Error())
+						if err == context.Canceled && ctx.Err() != nil {
+							// When canceled it means we just exit because we're shutting down,
+							// the journal is kept so the job is resumed on the next start
+							jr.Close()
+							d.suspend(torrent, prefix)
+							return
 						}
 
-						logFile.Close()
+						if err == context.Canceled && d.tm.Get(torrent.Hash) == nil {
+							// Removed from qBittorrent; the journal is kept so the
+							// job resumes if the torrent shows up again
+							jr.Close()
+						} else {
+							jr.Remove()
+						}
 					}
 
-					if err == nil && !unpackError {
+					if err == context.Canceled {
+						d.cancelUnpack(torrent, destPath, report, prefix)
+					} else if err == nil {
 						d.actions <- SetCategory{
 							hash:     torrent.Hash,
-							category: d.cfg.Categories.UnpackDone,
+							category: cfg.Categories.UnpackDone,
 						}
-					} else {
+						d.tm.HealReset(torrent.Hash)
+						d.tm.RetryReset(torrent.Hash)
+						d.finishUnpack(torrent, destPath, jobUnpacked, cfg.Categories.UnpackDone, nil, prefix)
+					} else if n := d.heal(err, torrent.Hash); n > 0 {
+						// Corrupt data on disk; recheck the torrent and unpack it
+						// again once qBittorrent has downloaded the bad pieces
+						log.Printf("[Unpack/%d] Rechecking torrent %s (%s) after %s, attempt %d of %d",
+							w, torrent.Hash, torrent.Name, err.Error(), n, cfg.Heal.Attempts)
+
+						d.actions <- Recheck{hash: torrent.Hash}
+						d.actions <- SetCategory{
+							hash:     torrent.Hash,
+							category: cfg.Categories.UnpackStart,
+						}
+						d.finishUnpack(torrent, destPath, jobFailed, cfg.Categories.UnpackStart, err, prefix)
+					} else if n, delay := d.retry(err, torrent.Hash); n > 0 {
+						// Possibly a passing problem; unpack the torrent again later
+						log.Printf("[Unpack/%d] Retrying torrent %s (%s) after %s in %s, attempt %d of %d",
+							w, torrent.Hash, torrent.Name, err.Error(), delay, n, cfg.Retry.Attempts+1)
+
 						d.actions <- SetCategory{
 							hash:     torrent.Hash,
-							category: d.cfg.Categories.Error,
+							category: cfg.Categories.UnpackStart,
 						}
+						d.finishUnpack(torrent, destPath, jobFailed, cfg.Categories.UnpackStart, err, prefix)
+					} else {
+						d.tm.RetryReset(torrent.Hash)
+						d.setError(torrent.Hash, err)
+						d.finishUnpack(torrent, destPath, jobFailed, "", err, prefix)
 					}
 				}
 			}
 
 			// Remove the queued status from this torrent
 			d.tm.JobDone(torrent.Hash)
+		case <-quit:
+			return
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func (d *Dispatcher) workerCheck(ctx context.Context, w uint, jobs <-chan TorrentJob) {
-	d.waitGroupEnter()
+// checkJob checks a torrent the way the daemon does, for the check
+// workers and the backfill command. It runs the check hooks around
+// checkTorrent, applies the rules and records the result in the store.
+// apply gives the torrent its category, or its error state when the check
+// failed, before the post_check hook runs; an error it returns fails the
+// job. It returns the category the torrent got.
+func checkJob(ctx context.Context, cfg *config, up *Unpacker, store *stateStore, t *Torrent,
+	prefix string, apply func(category string, err error) error) (string, error) {
+
+	runHook(ctx, cfg, hookPreCheck, &hookJob{torrent: t, category: t.Category}, nil, prefix)
+
+	category, err := checkTorrent(ctx, cfg, up, t, prefix)
+	if err == context.Canceled {
+		return "", err
+	} else if err == nil {
+		category = decide(cfg, t, category, prefix)
+		recordJob(store, t, func(rec *jobRecord) {
+			rec.Status = jobChecked
+			rec.Category = category
+			rec.Error, rec.ErrorType = "", ""
+			rec.Checked = time.Now()
+		})
+	} else {
+		recordJob(store, t, func(rec *jobRecord) {
+			rec.setResult(jobFailed, "", err)
+		})
+		category = errorCategory(cfg, err)
+	}
+
+	if aerr := apply(category, err); err == nil {
+		err = aerr
+	}
+
+	runHook(ctx, cfg, hookPostCheck, &hookJob{
+		torrent:  t,
+		category: category,
+		result:   checkResult(err),
+		err:      err,
+	}, nil, prefix)
+
+	return category, err
+}
+
+// testTargets runs the integrity test of all targets and returns true
+// if any of them is corrupt. The only error returned is cancellation.
+func testTargets(ctx context.Context, targets []*Target, prefix string) (bool, error) {
+	corrupt := false
+	for _, target := range targets {
+		var out bytes.Buffer
+		err := target.Test(ctx, &out)
+		switch err {
+		case nil:
+		case context.Canceled:
+			return false, err
+		case ErrTestUnsupported:
+			log.Printf("%s Skipping test of %s; %s", prefix, target.String(), err.Error())
+		case ErrTestFailed:
+			corrupt = true
+			log.Printf("%s Archive %s is corrupt:\n%s", prefix, target.String(), out.String())
+		default:
+			log.Printf("%s Error testing archive %s; %s", prefix, target.String(), err.Error())
+		}
+	}
+	return corrupt, nil
+}
+
+// checkTorrent scans a torrent for archives, sets the file permissions
+// and runs the integrity test if enabled. It returns the category the
+// torrent should get.
+func checkTorrent(ctx context.Context, cfg *config, up *Unpacker, t *Torrent, prefix string) (string, error) {
+	scanPath := filepath.Join(t.SavePath, t.Name)
+
+	// Scan the path for targets
+	targets, err := up.ScanPath(ctx, scanPath)
+	if err != nil {
+		return "", err
+	}
+
+	if err := setPermissions(scanPath, cfg); err != nil {
+		return "", err
+	}
+
+	if len(targets) == 0 {
+		return cfg.Categories.NoArchive, nil
+	}
+
+	if cfg.Check.Test {
+		// Deep check; test the integrity of the archives
+		if corrupt, err := testTargets(ctx, targets, prefix); err != nil {
+			return "", err
+		} else if corrupt {
+			return cfg.Categories.Corrupt, nil
+		}
+	}
+
+	return cfg.Categories.Default, nil
+}
+
+func (d *Dispatcher) workerCheck(ctx context.Context, w uint, jobs <-chan TorrentJob, quit <-chan struct{}) {
 	defer d.waitGroupLeave()
 
 	for {
 		select {
 		case job := <-jobs:
 			torrent := job.GetTorrent()
+			cfg := d.cfg()
 			scanPath := filepath.Join(torrent.SavePath, torrent.Name)
-			log.Printf("[Check/%d] Checking %s (%s) for archives", w, torrent.Hash, scanPath)
 
-			// Scan the path for targets
-			targets, err := d.up.ScanPath(ctx, scanPath)
-			if err == context.Canceled {
-				return
-			} else if err == nil {
-				err = setPermissions(scanPath, d.cfg)
-				if err == nil {
-					if len(targets) == 0 {
-						d.actions <- SetCategory{
-							hash:     torrent.Hash,
-							category: d.cfg.Categories.NoArchive,
-						}
-					} else {
-						d.actions <- SetCategory{
-							hash:     torrent.Hash,
-							category: d.cfg.Categories.Default,
-						}
-					}
-				}
+			// Don't check a torrent again that was checked after it completed,
+			// only restore the category that was lost. A category that was
+			// removed while the daemon ran asks for a new check.
+			rec, ok := d.store.Get(torrent.Hash)
+			checked := ok && rec.Status == jobChecked && len(rec.Category) > 0 &&
+				!rec.Checked.Before(time.Unix(int64(torrent.CompletionOn), 0))
+			cleared := false
+			if check, ok := job.(*CheckTorrent); ok {
+				cleared = check.cleared
 			}
 
-			if err != nil {
-				log.Printf("[Check/%d] Error scanning path for torrent %s (%s); %s",
-					w, torrent.Hash, torrent.Name, err.Error())
+			if checked && !cleared {
+				log.Printf("[Check/%d] Torrent %s (%s) was already checked at %s",
+					w, torrent.Hash, torrent.Name, rec.Checked.Format(time.RFC3339))
 
 				d.actions <- SetCategory{
 					hash:     torrent.Hash,
-					category: d.cfg.Categories.Error,
+					category: rec.Category,
 				}
+				d.tm.JobDone(torrent.Hash)
+				continue
+			} else if ok && cleared {
+				log.Printf("[Check/%d] The category of torrent %s (%s) was removed, checking it again",
+					w, torrent.Hash, torrent.Name)
+				recordJob(d.store, torrent, func(rec *jobRecord) {
+					rec.setResult("", "", nil)
+					rec.Checked = time.Time{}
+				})
+			}
+
+			log.Printf("[Check/%d] Checking %s (%s) for archives", w, torrent.Hash, scanPath)
+
+			prefix := fmt.Sprintf("[Check/%d]", w)
+			_, err := checkJob(ctx, cfg, d.up, d.store, torrent, prefix, func(category string, err error) error {
+				if err == nil {
+					d.actions <- SetCategory{
+						hash:     torrent.Hash,
+						category: category,
+					}
+				} else {
+					log.Printf("[Check/%d] Error scanning path for torrent %s (%s); %s",
+						w, torrent.Hash, torrent.Name, err.Error())
+
+					d.setError(torrent.Hash, err)
+				}
+				return nil
+			})
+			if err == context.Canceled {
+				return
 			}
 
 			d.tm.JobDone(torrent.Hash)
+		case <-quit:
+			return
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
+// perform runs an action against qBittorrent, it is retried when the
+// request times out
+func (d *Dispatcher) perform(ctx context.Context, tc *QbClient, actionType interface{}) error {
+	var err error
+
+	// retry loop
+	for {
+		actx, cancel := context.WithTimeout(ctx, time.Duration(d.cfg().Polling.Timeout)*time.Second)
+
+		switch actionType.(type) {
+		case GetTorrents:
+			if d.cfg().Scheduler.MaxDownload > 0 {
+				// The download rate may defer the unpack jobs
+				if info, err := tc.GetTransferInfo(actx); err == nil {
+					d.tm.SetDownloadRate(info.DlSpeed)
+				}
+			}
+			torrents, err := tc.GetTorrents(actx, nil)
+			if err == nil {
+				d.tm.Update(torrents)
+				d.prune(torrents)
+				d.resetTimer()
+			}
+			if err == nil && !d.limiter.restored {
+				d.restoreThrottle(actx, tc, torrents)
+			}
+
+		case AddCategory:
+			action, _ := actionType.(AddCategory)
+			err = tc.AddCategory(actx, action.category)
+			switch err {
+			case ErrCategoryBad:
+				log.Printf("[Manager] Failed to add category %s (does it already exist?)\n", action.category)
+				err = nil
+			case nil:
+				log.Println("[Manager] Added category", action.category, "to torrent client")
+			}
+
+		case SetCategory:
+			action, _ := actionType.(SetCategory)
+			err = tc.SetCategory(actx, action.hash, action.category)
+			if err == nil {
+				log.Printf("[Manager] Category for torrent %s changed to %s\n", action.hash, action.category)
+			}
+
+		case AddTags:
+			action, _ := actionType.(AddTags)
+			err = tc.AddTags(actx, action.hash, action.tags)
+			if err == nil {
+				log.Printf("[Manager] Tags %s added to torrent %s\n", action.tags, action.hash)
+			}
+
+		case RemoveTags:
+			action, _ := actionType.(RemoveTags)
+			err = tc.RemoveTags(actx, action.hash, action.tags)
+
+		case Recheck:
+			action, _ := actionType.(Recheck)
+			err = tc.Recheck(actx, action.hash)
+			if err == nil {
+				// Paused torrents must be resumed to download the bad pieces
+				err = tc.Resume(actx, action.hash)
+			}
+			if err == nil {
+				log.Printf("[Manager] Recheck of torrent %s started\n", action.hash)
+			}
+
+		case DeQueue:
+			action, _ := actionType.(DeQueue)
+			d.tm.JobDone(action.hash)
+
+		case Reload:
+			action, _ := actionType.(Reload)
+			err = d.reload(actx, tc, action.cfg)
+
+		case Throttle:
+			action, _ := actionType.(Throttle)
+			err = d.throttle(actx, tc, action.hash)
+
+		case Unthrottle:
+			action, _ := actionType.(Unthrottle)
+			err = d.unthrottle(actx, tc, action.hash)
+		}
+
+		cancel()
+
+		// Retry on a timeout, unless ctx itself has expired
+		if err == context.DeadlineExceeded && ctx.Err() == nil {
+			d.logTimeout(err)
+			continue
+		}
+
+		return err
+	}
+}
+
 // Run ...
 func (d Dispatcher) Run(ctx context.Context) {
 
@@ -303,7 +1024,7 @@ func (d Dispatcher) Run(ctx context.Context) {
 	defer d.stopTimer()
 
 	// Create a new torrent API client
-	tc := NewTorrentClient(d.cfg.Server, d.cfg.Port, d.cfg.Username, d.cfg.Password)
+	tc := NewTorrentClient(d.cfg().Server, d.cfg().Port, d.cfg().Username, d.cfg().Password)
 
 	// Setup logging callbacks
 	d.tm.setAddEvent(func(t *Torrent) {
@@ -312,30 +1033,55 @@ func (d Dispatcher) Run(ctx context.Context) {
 	d.tm.setRemoveEvent(func(t *Torrent) {
 		log.Printf("[Queue] Removed torrent %s (%s)\n", t.Hash, t.Name)
 	})
-	d.tm.setQueueFullEvent(func(t *Torrent, j TorrentJob) {
-		log.Printf("[Queue] Job queue full; failed to enqueue torrent %s (%s) for job %T\n", t.Hash, t.Name, j)
+	d.tm.setIgnoreEvent(func(t *Torrent) {
+		log.Printf("[Queue] Ignoring torrent %s (%s), it completed before %s\n",
+			t.Hash, t.Name, d.cfg().CheckCutoff().Format(time.RFC3339))
+	})
+	d.tm.setCancelEvent(func(t *Torrent, reason string) {
+		log.Printf("[Queue] Canceling the job of torrent %s (%s), %s\n", t.Hash, t.Name, reason)
+	})
+	d.tm.setPositionEvent(func(t *Torrent, queue string, old, position int) {
+		// Only the position a torrent is queued at is logged, the tag
+		// follows it as the jobs ahead start
+		if old == 0 {
+			log.Printf("[Queue] Torrent %s (%s) is number %d in the %s queue\n", t.Hash, t.Name, position, queue)
+		}
+		if old > 0 {
+			d.actions <- RemoveTags{hash: t.Hash, tags: queueTag(old)}
+		}
+		if position > 0 {
+			d.actions <- AddTags{hash: t.Hash, tags: queueTag(position)}
+		}
+	})
+	d.tm.setDeferEvent(func(reason string) {
+		if len(reason) > 0 {
+			log.Printf("[Queue] Deferring unpack jobs, %s\n", reason)
+		} else {
+			log.Println("[Queue] Unpack jobs may start again")
+		}
+	})
+	d.tm.setWaitEvent(func(t *Torrent, reason string) {
+		if len(reason) > 0 {
+			log.Printf("[Queue] Torrent %s (%s) is waiting to unpack, %s\n", t.Hash, t.Name, reason)
+			d.actions <- AddTags{hash: t.Hash, tags: tagWaiting}
+		} else {
+			d.actions <- RemoveTags{hash: t.Hash, tags: tagWaiting}
+		}
 	})
 
-	// Start the torrent unpack workers
-	for i := uint(0); i < d.cfg.Workers.Unpack; i++ {
-		go d.workerUnpack(ctx, i, d.tm.QueueA())
-	}
+	// Start handing jobs to the workers
+	d.tm.Start(d.feed)
 
-	// Start the torrent check workers
-	for i := uint(0); i < d.cfg.Workers.Check; i++ {
-		go d.workerCheck(ctx, i, d.tm.QueueB())
-	}
+	// Start the torrent unpack and check workers
+	d.startWorkers()
 
 	// Buffer the initial actions
-	d.actions <- AddCategory{category: d.cfg.Categories.Default}
-	d.actions <- AddCategory{category: d.cfg.Categories.Error}
-	d.actions <- AddCategory{category: d.cfg.Categories.NoArchive}
-	d.actions <- AddCategory{category: d.cfg.Categories.UnpackBusy}
-	d.actions <- AddCategory{category: d.cfg.Categories.UnpackDone}
-	d.actions <- AddCategory{category: d.cfg.Categories.UnpackStart}
+	for _, category := range d.cfg().CategoryNames() {
+		d.actions <- AddCategory{category: category}
+	}
 	d.actions <- GetTorrents{}
 
-	log.Printf("[Manager] Up and running with %d workers", d.cfg.Workers.Check+d.cfg.Workers.Unpack)
+	log.Printf("[Manager] Up and running with %d workers", d.cfg().Workers.Check+d.cfg().Workers.Unpack)
 
 	// Main loop
 	loop := true
@@ -343,50 +1089,7 @@ func (d Dispatcher) Run(ctx context.Context) {
 		var err error
 		select {
 		case actionType := <-d.actions:
-			// retry loop
-			for {
-				ctx, cancel := context.WithTimeout(ctx, time.Duration(d.cfg.Polling.Timeout)*time.Second)
-
-				switch actionType.(type) {
-				case GetTorrents:
-					torrents, err := tc.GetTorrents(ctx, nil)
-					if err == nil {
-						d.tm.Update(torrents)
-						d.resetTimer()
-					}
-
-				case AddCategory:
-					action, _ := actionType.(AddCategory)
-					err = tc.AddCategory(ctx, action.category)
-					switch err {
-					case ErrCategoryBad:
-						log.Printf("[Manager] Failed to add category %s (does it already exist?)\n", action.category)
-						err = nil
-					case nil:
-						log.Println("[Manager] Added category", action.category, "to torrent client")
-					}
-
-				case SetCategory:
-					action, _ := actionType.(SetCategory)
-					err = tc.SetCategory(ctx, action.hash, action.category)
-					if err == nil {
-						log.Printf("[Manager] Category for torrent %s changed to %s\n", action.hash, action.category)
-					}
-
-				case DeQueue:
-					action, _ := actionType.(DeQueue)
-					d.tm.JobDone(action.hash)
-				}
-
-				cancel()
-
-				if err == context.DeadlineExceeded {
-					d.logTimeout(err)
-					continue
-				}
-
-				break
-			}
+			err = d.perform(ctx, tc, actionType)
 
 			if err != nil {
 				switch err {
@@ -415,6 +1118,10 @@ func (d Dispatcher) Run(ctx context.Context) {
 		}
 	}
 
+	// Stop the workers, unless Shutdown did already, and send
+	// the changes they made on their way out to qBittorrent
+	d.stopJobs()
 	d.wg.Wait()
+	d.flush(tc)
 	log.Println("[Manager] Shutting down")
 }
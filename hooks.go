@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Hooks that run user scripts around the jobs
+const (
+	hookPreCheck   = "pre_check"
+	hookPostCheck  = "post_check"
+	hookPreUnpack  = "pre_unpack"
+	hookPostUnpack = "post_unpack"
+)
+
+// hookJob describes the job a hook runs for, it is passed to the hook
+// in QBD_ environment variables
+type hookJob struct {
+	torrent  *Torrent
+	category string
+	dest     string
+	result   string
+	err      error
+}
+
+// command returns the script of a hook, or an empty string if it isn't set
+func (h *hooks) command(hook string) string {
+	switch hook {
+	case hookPreCheck:
+		return h.PreCheck
+	case hookPostCheck:
+		return h.PostCheck
+	case hookPreUnpack:
+		return h.PreUnpack
+	case hookPostUnpack:
+		return h.PostUnpack
+	}
+	return ""
+}
+
+// environ returns the environment of a hook
+func (job *hookJob) environ(hook string) []string {
+	env := append(os.Environ(),
+		"QBD_HOOK="+hook,
+		"QBD_HASH="+job.torrent.Hash,
+		"QBD_NAME="+job.torrent.Name,
+		"QBD_CATEGORY="+job.category,
+		"QBD_SAVE_PATH="+job.torrent.SavePath,
+		"QBD_DEST="+job.dest,
+		"QBD_RESULT="+job.result,
+		"QBD_ERROR_TYPE="+errorType(job.err),
+	)
+
+	// The files are only listed once the job has written them
+	files, report := "", ""
+	if len(job.dest) > 0 {
+		if path := filepath.Join(job.dest, unpackManifestName); fileExists(path) {
+			files = path
+		}
+		if path := filepath.Join(job.dest, unpackReportName); fileExists(path) {
+			report = path
+		}
+	}
+	env = append(env, "QBD_FILES="+files, "QBD_REPORT="+report)
+
+	if job.err != nil {
+		env = append(env, "QBD_ERROR="+job.err.Error())
+	} else {
+		env = append(env, "QBD_ERROR=")
+	}
+	return env
+}
+
+// fileExists returns true if path is an existing file
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// checkResult returns the result of a check job for its hooks
+func checkResult(err error) string {
+	if err != nil {
+		return jobFailed
+	}
+	return jobChecked
+}
+
+// errorCategory returns the category a torrent gets for an error
+func errorCategory(cfg *config, err error) string {
+	if state := cfg.Errors.State(err); len(state) > 0 && !cfg.Errors.Tags {
+		return state
+	}
+	return cfg.Categories.Error
+}
+
+// runHook runs the script of a hook for a job, if it's set. The output of
+// the script is written to w, or to the log if w is nil. Failures of the
+// script are logged but don't change the job.
+func runHook(ctx context.Context, cfg *config, hook string, job *hookJob, w io.Writer, prefix string) {
+	command := cfg.Hooks.command(hook)
+	if len(command) == 0 {
+		return
+	}
+
+	// A timeout of 0 lets the hook run until the job is stopped
+	timeout := time.Duration(cfg.Hooks.Timeout) * time.Second
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	if w != nil {
+		fmt.Fprintf(w, "--- %s hook %s\n", hook, command)
+	} else {
+		w = ioutil.Discard
+	}
+
+	tool := exec.CommandContext(ctx, command)
+	tool.Env = job.environ(hook)
+
+	status, output, err := runTool(ctx, tool, nil, w)
+	if w == ioutil.Discard && len(output) > 0 {
+		log.Printf("%s Output of the %s hook of %s:\n%s", prefix, hook, job.torrent.Hash,
+			strings.TrimRight(string(output), "\n"))
+	}
+
+	switch {
+	case err == context.DeadlineExceeded:
+		log.Printf("%s The %s hook of %s (%s) timed out after %s", prefix, hook, job.torrent.Hash, job.torrent.Name, timeout)
+	case err != nil:
+		log.Printf("%s Error running the %s hook of %s (%s); %s", prefix, hook, job.torrent.Hash, job.torrent.Name, err.Error())
+	case status != 0:
+		log.Printf("%s The %s hook of %s (%s) exited with status %d", prefix, hook, job.torrent.Hash, job.torrent.Name, status)
+	}
+}
+
+// runUnpackHook runs a hook of an unpack job, its output is added to
+// unpack.log in the destination if there is one
+func (d *Dispatcher) runUnpackHook(hook string, job *hookJob, prefix string) {
+	if len(d.cfg().Hooks.command(hook)) == 0 {
+		return
+	}
+
+	if info, err := os.Stat(job.dest); err == nil && info.IsDir() {
+		if logFile, err := openUnpackLog(job.dest, true); err == nil {
+			defer logFile.Close()
+			runHook(d.jobs, d.cfg(), hook, job, logFile, prefix)
+			return
+		}
+	}
+	runHook(d.jobs, d.cfg(), hook, job, nil, prefix)
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// fileInode is not supported on this platform, hard links are not checked
+// and per device limits don't apply
+func fileInode(info os.FileInfo) (inode, uint64, bool) {
+	return inode{}, 0, false
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+)
+
+// Journal of the unpacked targets written into the destination of a job
+const unpackJournalName = "unpack.journal"
+
+// Policies for unpack jobs that were interrupted by a crash or restart
+const (
+	resumeJob = "resume"
+	resetJob  = "reset"
+)
+
+// journal records the targets of an unpack job that finished, so an
+// interrupted job can continue with the first unfinished target
+type journal struct {
+	path string
+	file *os.File
+	done map[string]bool
+}
+
+// openJournal opens the journal in dest. Unless resuming, the targets
+// recorded by a previous job are forgotten.
+func openJournal(dest string, resume bool) (*journal, error) {
+	jr := &journal{
+		path: filepath.Join(dest, unpackJournalName),
+		done: make(map[string]bool),
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if resume {
+		if file, err := os.Open(jr.path); err == nil {
+			scanner := bufio.NewScanner(file)
+			for scanner.Scan() {
+				jr.done[scanner.Text()] = true
+			}
+			file.Close()
+		}
+	} else {
+		flags |= os.O_TRUNC
+	}
+
+	file, err := os.OpenFile(jr.path, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	jr.file = file
+	return jr, nil
+}
+
+// Done returns true if the target was unpacked by an earlier run of the job
+func (jr *journal) Done(target *Target) bool {
+	return jr != nil && jr.done[target.String()]
+}
+
+// Finish records a target as unpacked, a nil journal records nothing
+func (jr *journal) Finish(target *Target) error {
+	if jr == nil {
+		return nil
+	}
+	jr.done[target.String()] = true
+	if _, err := jr.file.WriteString(target.String() + "\n"); err != nil {
+		return err
+	}
+	return jr.file.Sync()
+}
+
+// Close closes the journal, which is kept for resuming the job
+func (jr *journal) Close() error {
+	return jr.file.Close()
+}
+
+// Remove closes and deletes the journal once the job has ended
+func (jr *journal) Remove() error {
+	jr.file.Close()
+	return os.Remove(jr.path)
+}
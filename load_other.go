@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// loadAverage is only supported on Linux
+func loadAverage() (float64, error) {
+	return 0, errors.New("load average is only supported on Linux")
+}
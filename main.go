@@ -7,6 +7,8 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"syscall"
+	"time"
 )
 
 func setOverrides(config *config, dest string, temp string) {
@@ -18,8 +20,58 @@ func setOverrides(config *config, dest string, temp string) {
 	}
 }
 
+// reloadConfig loads and validates the config file again, with the
+// same overrides as at startup
+func reloadConfig(current *config, path string, dest string, temp string) (*config, error) {
+	next := newConfig()
+	if err := next.loadConfig(path); err != nil {
+		return nil, err
+	}
+	setOverrides(next, dest, temp)
+	if err := next.Validate(); err != nil {
+		return nil, err
+	}
+	next.installed = current.installed
+	return next, nil
+}
+
+// watchConfig signals changed when the modification time of the config
+// file changes
+func watchConfig(ctx context.Context, path string, changed chan<- struct{}) {
+	var modTime time.Time
+	if fi, err := os.Stat(path); err == nil {
+		modTime = fi.ModTime()
+	}
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			fi, err := os.Stat(path)
+			if err != nil || fi.ModTime().Equal(modTime) {
+				continue
+			}
+			modTime = fi.ModTime()
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
 func main() {
 
+	// When started as the sandbox helper for an extractor, restrict
+	// this process and exec the extractor. This never returns.
+	if len(os.Args) > 1 && os.Args[1] == sandboxArg {
+		runSandboxed(os.Args[2:])
+	}
+
 	// Create the default config, this is not valid as it's
 	// missing the destination path
 	config := newConfig()
@@ -37,27 +89,16 @@ func main() {
 	writeConfPath := flag.String(
 		"wconf", "", "write default configuration to this location")
 
-	testPath := flag.String("test", "", "a test test")
-
 	var forceWrite bool
 	flag.BoolVar(&forceWrite, "force",
 		false, "force overwriting when using -wconf")
 
+	flag.Usage = usage
 	flag.Parse()
 
-	if len(*testPath) > 0 {
-		up, err := NewUnpacker()
-		if err != nil {
-			log.Fatalln(err)
-		}
-		files, err := up.ScanPath(context.Background(), *testPath)
-		if err != nil {
-			log.Fatalln(err)
-		}
-		for _, path := range files {
-			fmt.Println(path)
-		}
-		os.Exit(0)
+	// Run an offline subcommand instead of the daemon
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(config, *configFile, flag.Args()))
 	}
 
 	// Handle writing the default config to a file. This
@@ -97,12 +138,27 @@ func main() {
 		log.Fatalln(err)
 	}
 
-	// Signals to catch CTRL-C
+	// Signals to catch CTRL-C and service managers stopping the daemon
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, os.Interrupt)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	// SIGHUP reloads the configuration
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 
 	// Create the unpacker
-	up, err := NewUnpacker()
+	up, err := NewUnpacker(config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// The first start of the daemon is kept in the state path
+	if config.installed, err = installTime(config.StatePath); err != nil {
+		log.Fatalln(err)
+	}
+
+	// Open the job state store
+	store, err := openStateStore(config.StatePath)
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -111,21 +167,62 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	draining := false
+
 	// Create and start the API dispatcher
-	d := NewDispatcher(config, up)
+	d := NewDispatcher(config, up, store)
 	go d.Run(ctx)
 
+	// Optionally reload the configuration when the file changes
+	changed := make(chan struct{}, 1)
+	if config.Watch {
+		go watchConfig(ctx, *configFile, changed)
+	}
+
+	reload := func(why string) {
+		if draining {
+			return
+		}
+		log.Printf("Reloading the configuration (%s)", why)
+		next, err := reloadConfig(d.cfg(), *configFile, *destPath, *tempPath)
+		if err != nil {
+			log.Printf("Keeping the old configuration; %s", err.Error())
+			return
+		}
+		d.Reload(next)
+	}
+
 	// Main loop
 	for {
 		select {
 		case <-ctx.Done():
 			d.Done()
+			if err := store.Close(); err != nil {
+				log.Printf("Error closing the state store; %s", err.Error())
+			}
 			log.Println("Qbdaemon exiting")
 			os.Exit(0)
 
 		case why := <-sigs:
+			if draining {
+				// A second signal doesn't wait for the running jobs
+				log.Printf("Stopping running jobs (%s)", why.String())
+				d.StopJobs()
+				continue
+			}
+
 			log.Printf("Shutting down (%s)", why.String())
-			cancel()
+			draining = true
+			go func() {
+				d.Shutdown(time.Duration(d.cfg().Workers.Drain) * time.Second)
+				cancel()
+			}()
+
+		case why := <-hup:
+			reload(why.String())
+
+		case <-changed:
+			reload("file changed")
 
 		case err := <-d.Result():
 			if err != nil {
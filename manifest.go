@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Manifest of the extracted files written into the destination
+const unpackManifestName = "manifest.json"
+
+// manifestEntry is a file in the destination with its size and hash
+type manifestEntry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// ownFile returns true for the files qbdaemon writes into a destination
+func ownFile(rel string) bool {
+	return rel == unpackLogName || rel == unpackReportName ||
+		rel == unpackManifestName || rel == unpackJournalName ||
+		rel == unpackStagingName
+}
+
+// hashFile returns the hex encoded SHA-256 of a file
+func hashFile(ctx context.Context, path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, &ctxReader{ctx: ctx, r: file}); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// ctxReader stops reading when the context is canceled
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// buildManifest hashes the regular files at or below the given paths
+// relative to dest, sorted by path
+func buildManifest(ctx context.Context, dest string, paths []string) ([]manifestEntry, error) {
+	entries := []manifestEntry{}
+	seen := make(map[string]bool)
+	for _, root := range paths {
+		err := filepath.Walk(filepath.Join(dest, root), func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return err
+			}
+
+			rel, err := filepath.Rel(dest, path)
+			if err != nil || ownFile(rel) || seen[rel] {
+				return err
+			}
+			seen[rel] = true
+
+			sum, err := hashFile(ctx, path)
+			if err != nil {
+				return err
+			}
+
+			entries = append(entries, manifestEntry{
+				Path:   filepath.ToSlash(rel),
+				Size:   info.Size(),
+				SHA256: sum,
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries, nil
+}
+
+// writeManifest writes the manifest of the extracted paths to dest
+func writeManifest(ctx context.Context, dest string, paths []string) error {
+	entries, err := buildManifest(ctx, dest, paths)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dest, unpackManifestName), data, 0644)
+}
+
+// readManifest reads the manifest of a destination
+func readManifest(dest string) ([]manifestEntry, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dest, unpackManifestName))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []manifestEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("invalid %s; %s", unpackManifestName, err.Error())
+	}
+	return entries, nil
+}
+
+// verifyManifest checks the files in the manifest of dest and calls fn
+// with every file that is missing or changed. Files that aren't in the
+// manifest are left alone. It returns the number of files that failed.
+func verifyManifest(ctx context.Context, dest string, fn func(status, path string)) (int, error) {
+	want, err := readManifest(dest)
+	if err != nil {
+		return 0, err
+	}
+
+	failed := 0
+	for _, entry := range want {
+		path := filepath.Join(dest, filepath.FromSlash(entry.Path))
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			fn("MISSING", entry.Path)
+			failed++
+			continue
+		} else if err != nil {
+			return failed, err
+		}
+
+		sum := ""
+		if info.Mode().IsRegular() && info.Size() == entry.Size {
+			if sum, err = hashFile(ctx, path); err != nil {
+				return failed, err
+			}
+		}
+		if sum != entry.SHA256 {
+			fn("CHANGED", entry.Path)
+			failed++
+		}
+	}
+
+	return failed, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// priority holds the scheduling settings for unpack jobs. A nil
+// priority leaves the extractors at the daemon's own priority.
+type priority struct {
+	nice    int
+	ioClass int
+	ioLevel int
+	cgroup  string
+	rate    uint64
+}
+
+// rateLimit caps the throughput of native formats to a number of
+// bytes per second, shared by all writers of a single unpack
+type rateLimit struct {
+	ctx     context.Context
+	rate    uint64
+	start   time.Time
+	written uint64
+}
+
+type limitedWriter struct {
+	limit *rateLimit
+	w     io.Writer
+}
+
+// Limit returns a rate limiter for one unpack, or nil if there is no cap
+func (p *priority) Limit(ctx context.Context) *rateLimit {
+	if p == nil || p.rate == 0 {
+		return nil
+	}
+	return &rateLimit{ctx: ctx, rate: p.rate, start: time.Now()}
+}
+
+// Writer wraps w so that writes are throttled by the rate limit
+func (rl *rateLimit) Writer(w io.Writer) io.Writer {
+	if rl == nil {
+		return w
+	}
+	return &limitedWriter{limit: rl, w: w}
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	n, err := lw.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	rl := lw.limit
+	rl.written += uint64(n)
+	due := time.Duration(float64(rl.written) / float64(rl.rate) * float64(time.Second))
+	if wait := due - time.Since(rl.start); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-rl.ctx.Done():
+			return n, rl.ctx.Err()
+		}
+	}
+
+	return n, nil
+}
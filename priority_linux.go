@@ -0,0 +1,124 @@
+//go:build linux
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"syscall"
+)
+
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+)
+
+// writeCgroup writes a value to a cgroup control file
+func writeCgroup(path, file, value string) error {
+	return ioutil.WriteFile(filepath.Join(path, file), []byte(value), 0644)
+}
+
+func newPriority(w *workers) *priority {
+	p := &priority{
+		nice:    w.Nice,
+		ioClass: w.IOClass,
+		ioLevel: w.IOLevel,
+		cgroup:  w.Cgroup,
+		rate:    w.Rate,
+	}
+
+	if len(p.cgroup) > 0 {
+		if err := os.MkdirAll(p.cgroup, 0755); err != nil {
+			log.Printf("[Priority] Warning: cgroup %s disabled; %s", p.cgroup, err.Error())
+			p.cgroup = ""
+		} else {
+			// Enable the controllers for our cgroup in its parent
+			parent := filepath.Dir(p.cgroup)
+			for _, ctrl := range []string{"+cpu", "+io"} {
+				if err := writeCgroup(parent, "cgroup.subtree_control", ctrl); err != nil {
+					log.Printf("[Priority] Warning: could not enable %s controller in %s; %s",
+						ctrl[1:], parent, err.Error())
+				}
+			}
+
+			if len(w.CPUMax) > 0 {
+				if err := writeCgroup(p.cgroup, "cpu.max", w.CPUMax); err != nil {
+					log.Printf("[Priority] Warning: could not set cpu.max; %s", err.Error())
+				}
+			}
+
+			for _, line := range w.IOMax {
+				if err := writeCgroup(p.cgroup, "io.max", line); err != nil {
+					log.Printf("[Priority] Warning: could not set io.max '%s'; %s", line, err.Error())
+				}
+			}
+		}
+	}
+
+	if p.nice == 0 && p.ioClass == 0 && len(p.cgroup) == 0 && p.rate == 0 {
+		return nil
+	}
+
+	return p
+}
+
+// Start starts an extractor at the configured priority. The nice level
+// and io priority are set on a locked thread that starts the extractor,
+// which inherits them, so the extractor and the processes it starts never
+// run at the daemon's priority. The extractor is created in the cgroup,
+// which needs Linux 5.7 or later.
+func (p *priority) Start(tool *exec.Cmd) error {
+	if p == nil {
+		return tool.Start()
+	}
+
+	if len(p.cgroup) > 0 {
+		dir, err := os.Open(p.cgroup)
+		if err != nil {
+			log.Printf("[Priority] Could not open cgroup %s; %s", p.cgroup, err.Error())
+		} else {
+			defer dir.Close()
+			if tool.SysProcAttr == nil {
+				tool.SysProcAttr = &syscall.SysProcAttr{}
+			}
+			tool.SysProcAttr.UseCgroupFD = true
+			tool.SysProcAttr.CgroupFD = int(dir.Fd())
+		}
+	}
+
+	if p.nice == 0 && p.ioClass == 0 {
+		return tool.Start()
+	}
+
+	started := make(chan error)
+	go func() {
+		// The thread isn't unlocked, so it ends with this goroutine and
+		// its priority is never used for anything else
+		runtime.LockOSThread()
+		p.setThread(syscall.Gettid())
+		started <- tool.Start()
+	}()
+	return <-started
+}
+
+// setThread sets the nice level and io priority of a thread, on Linux
+// these are per thread and inherited by the processes it starts
+func (p *priority) setThread(tid int) {
+	if p.nice != 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, p.nice); err != nil {
+			log.Printf("[Priority] Could not set nice level; %s", err.Error())
+		}
+	}
+
+	if p.ioClass != 0 {
+		prio := p.ioClass<<ioprioClassShift | p.ioLevel
+		_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(prio))
+		if errno != 0 {
+			log.Printf("[Priority] Could not set io priority; %s", errno.Error())
+		}
+	}
+}
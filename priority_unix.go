@@ -0,0 +1,36 @@
+//go:build !linux && !windows
+
+package main
+
+import (
+	"log"
+	"os/exec"
+	"syscall"
+)
+
+func newPriority(w *workers) *priority {
+	if w.IOClass != 0 || len(w.Cgroup) > 0 {
+		log.Println("[Priority] Warning: ionice and cgroups are only supported on Linux")
+	}
+
+	if w.Nice == 0 && w.Rate == 0 {
+		return nil
+	}
+
+	return &priority{nice: w.Nice, rate: w.Rate}
+}
+
+// Start starts an extractor and sets its nice level. Unlike on Linux the
+// nice level of a thread can't be inherited, so the extractor runs at the
+// daemon's priority for the moment between its start and the change.
+func (p *priority) Start(tool *exec.Cmd) error {
+	if err := tool.Start(); err != nil || p == nil || p.nice == 0 {
+		return err
+	}
+
+	pid := tool.Process.Pid
+	if err := syscall.Setpriority(syscall.PRIO_PROCESS, pid, p.nice); err != nil {
+		log.Printf("[Priority] Could not set nice level of %d; %s", pid, err.Error())
+	}
+	return nil
+}
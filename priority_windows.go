@@ -0,0 +1,23 @@
+package main
+
+import (
+	"log"
+	"os/exec"
+)
+
+func newPriority(w *workers) *priority {
+	if w.Nice != 0 || w.IOClass != 0 || len(w.Cgroup) > 0 {
+		log.Println("[Priority] Warning: nice, ionice and cgroups are not supported on Windows")
+	}
+
+	if w.Rate == 0 {
+		return nil
+	}
+
+	return &priority{rate: w.Rate}
+}
+
+// Start starts an extractor, only the rate cap is supported on Windows
+func (p *priority) Start(tool *exec.Cmd) error {
+	return tool.Start()
+}
@@ -102,6 +102,14 @@ type Torrent struct {
 	Hash         string  `json:"hash"`
 	Progress     float32 `json:"progress"`
 	SavePath     string  `json:"save_path"`
+	Tags         string  `json:"tags"`
+	Tracker      string  `json:"tracker"`
+}
+
+// TransferInfo contains the global transfer rates of qBittorrent
+type TransferInfo struct {
+	DlSpeed uint64 `json:"dl_info_speed"`
+	UpSpeed uint64 `json:"up_info_speed"`
 }
 
 // ErrLogin is returned when the credentials are incorrect
@@ -141,7 +149,12 @@ func (t Torrent) IsCompleted() bool {
 	return t.Size == t.Completed && t.Progress == 1.0 &&
 		(t.State == "pausedUP" || t.State == "queuedUP" ||
 			t.State == "uploading" || t.State == "stalledUP" ||
-			t.State == "checkingUP")
+			t.State == "checkingUP" || t.State == "stoppedUP")
+}
+
+// IsPaused returns true if the torrent is paused, or stopped in qBittorrent 5
+func (t Torrent) IsPaused() bool {
+	return strings.HasPrefix(t.State, "paused") || strings.HasPrefix(t.State, "stopped")
 }
 
 // HasCategory returns true if the torrent is assigned a category
@@ -149,6 +162,16 @@ func (t Torrent) HasCategory() bool {
 	return len(t.Category) > 0
 }
 
+// HasTag returns true if the torrent has the given tag
+func (t Torrent) HasTag(tag string) bool {
+	for _, tt := range strings.Split(t.Tags, ",") {
+		if strings.TrimSpace(tt) == tag {
+			return true
+		}
+	}
+	return false
+}
+
 // IsAuthenticated returns true if the client is authenticated
 func (client *QbClient) IsAuthenticated() bool {
 	return len(client.cookie) > 0
@@ -332,10 +355,101 @@ func (client *QbClient) GetTorrents(ctx context.Context, tf *TorrentFilter) ([]*
 	}
 
 	var torrents []*Torrent
-	err = json.Unmarshal(body, &torrents)
+	if err = json.Unmarshal(body, &torrents); err != nil {
+		return nil, err
+	}
 	return torrents, nil
 }
 
+// GetTransferInfo ...
+func (client *QbClient) GetTransferInfo(ctx context.Context) (*TransferInfo, error) {
+
+	req, err := client.buildRequest(ctx,
+		"/api/v2/transfer/info",
+		"")
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.doRequest(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusForbidden {
+		client.clearCookie()
+		return nil, ErrForbidden
+	}
+
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &TransferInfo{}
+	if err = json.Unmarshal(body, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// SpeedLimitsMode returns true if the alternative speed limits are enabled
+func (client *QbClient) SpeedLimitsMode(ctx context.Context) (bool, error) {
+
+	req, err := client.buildRequest(ctx,
+		"/api/v2/transfer/speedLimitsMode",
+		"")
+
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := client.doRequest(ctx, req)
+	if err != nil {
+		return false, err
+	}
+
+	if resp.StatusCode == http.StatusForbidden {
+		client.clearCookie()
+		return false, ErrForbidden
+	}
+
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+
+	return strings.TrimSpace(string(body)) == "1", nil
+}
+
+// ToggleSpeedLimitsMode switches the alternative speed limits on or off
+func (client *QbClient) ToggleSpeedLimitsMode(ctx context.Context) error {
+
+	req, err := client.buildRequest(ctx,
+		"/api/v2/transfer/toggleSpeedLimitsMode",
+		"")
+
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.doRequest(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusForbidden {
+		client.clearCookie()
+		return ErrForbidden
+	}
+
+	return nil
+}
+
 // AddCategory ...
 func (client *QbClient) AddCategory(ctx context.Context, category string) error {
 
@@ -396,3 +510,84 @@ func (client *QbClient) SetCategory(ctx context.Context, hashes, category string
 
 	return nil
 }
+
+// AddTags ...
+func (client *QbClient) AddTags(ctx context.Context, hashes, tags string) error {
+	return client.editTags(ctx, "/api/v2/torrents/addTags", hashes, tags)
+}
+
+// RemoveTags ...
+func (client *QbClient) RemoveTags(ctx context.Context, hashes, tags string) error {
+	return client.editTags(ctx, "/api/v2/torrents/removeTags", hashes, tags)
+}
+
+func (client *QbClient) editTags(ctx context.Context, path, hashes, tags string) error {
+
+	query := url.Values{}
+	query.Add("hashes", hashes)
+	query.Add("tags", tags)
+
+	req, err := client.buildFormRequest(ctx, path, query.Encode())
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.doRequest(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusForbidden {
+		return ErrForbidden
+	}
+
+	return nil
+}
+
+// Recheck ...
+func (client *QbClient) Recheck(ctx context.Context, hashes string) error {
+	_, err := client.hashAction(ctx, "/api/v2/torrents/recheck", hashes)
+	return err
+}
+
+// Resume starts torrents, using the qBittorrent 5 endpoint as a fallback
+func (client *QbClient) Resume(ctx context.Context, hashes string) error {
+	status, err := client.hashAction(ctx, "/api/v2/torrents/resume", hashes)
+	if err == nil && status == http.StatusNotFound {
+		_, err = client.hashAction(ctx, "/api/v2/torrents/start", hashes)
+	}
+	return err
+}
+
+// Pause stops torrents, using the qBittorrent 5 endpoint as a fallback
+func (client *QbClient) Pause(ctx context.Context, hashes string) error {
+	status, err := client.hashAction(ctx, "/api/v2/torrents/pause", hashes)
+	if err == nil && status == http.StatusNotFound {
+		_, err = client.hashAction(ctx, "/api/v2/torrents/stop", hashes)
+	}
+	return err
+}
+
+func (client *QbClient) hashAction(ctx context.Context, path, hashes string) (int, error) {
+
+	query := url.Values{}
+	query.Add("hashes", hashes)
+
+	req, err := client.buildFormRequest(ctx, path, query.Encode())
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := client.doRequest(ctx, req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusForbidden {
+		return resp.StatusCode, ErrForbidden
+	}
+
+	return resp.StatusCode, nil
+}
@@ -1,12 +1,21 @@
 package main
 
 import (
+	"context"
+	"strings"
 	"sync"
 	"time"
 )
 
 type queueStatus int
 
+// Tag that cancels the unpacking of a torrent
+const tagCancel = "qbd:cancel"
+
+// Number of polls in a row a torrent has to be missing from qBittorrent
+// before it counts as removed
+const removedPolls = 3
+
 const (
 	tsDefault queueStatus = 0
 	tsQueued  queueStatus = 1
@@ -14,22 +23,42 @@ const (
 )
 
 type mapItem struct {
-	torrent *Torrent
-	status  queueStatus
-	time    time.Time
+	torrent  *Torrent
+	status   queueStatus
+	time     time.Time
+	heals    uint
+	healing  bool
+	healSeen bool
+	healTime time.Time
+	orphan   bool
+	position int
+	cancel   context.CancelFunc
+	busySeen bool
+	retries  uint
+	retryAt  time.Time
+	ignored  bool
+	waiting  bool
+	missing  int
+	cleared  bool
 }
 
 // TorrentQueue handles the queuing of torrent jobs
 type TorrentQueue struct {
-	data      map[string]*mapItem
-	mutex     sync.Mutex
-	config    *config
-	added     func(*Torrent)
-	updated   func(*Torrent)
-	removed   func(*Torrent)
-	queuefull func(*Torrent, TorrentJob)
-	queueA    chan TorrentJob
-	queueB    chan TorrentJob
+	data       map[string]*mapItem
+	mutex      sync.Mutex
+	config     *config
+	store      *stateStore
+	added      func(*Torrent)
+	updated    func(*Torrent)
+	removed    func(*Torrent)
+	positioned func(*Torrent, string, int, int)
+	canceled   func(*Torrent, string)
+	ignore     func(*Torrent)
+	queueA     *jobList
+	queueB     *jobList
+	dlRate     uint64
+	waited     func(*Torrent, string)
+	deferring  func(string)
 }
 
 // TorrentJob interface declaration
@@ -37,20 +66,48 @@ type TorrentJob interface {
 	GetTorrent() *Torrent
 }
 
-// CheckTorrent is a job type that checks a torrent for unpackable archives
+// CheckTorrent is a job type that checks a torrent for unpackable archives,
+// cleared is set when the category was removed while the daemon ran
 type CheckTorrent struct {
 	torrent *Torrent
+	cleared bool
 }
 
 // UnpackTorrent is a job type that tries to unpack torrent archives
 type UnpackTorrent struct {
 	torrent *Torrent
+	resume  bool
 }
 
 func (mi *mapItem) IsQueued() bool {
 	return mi.status == tsQueued
 }
 
+// IsWaiting returns true while an unpack waits for its next retry attempt
+func (mi *mapItem) IsWaiting() bool {
+	return time.Now().Before(mi.retryAt)
+}
+
+// IsHealing returns true while a recheck requested by Heal is running
+func (mi *mapItem) IsHealing() bool {
+	return mi.healing
+}
+
+// updateHeal follows a torrent through its recheck. Healing ends when the
+// torrent is complete again after it was seen checking or downloading,
+// or when it was never seen doing so within the grace period.
+func (mi *mapItem) updateHeal(t *Torrent, grace time.Duration) {
+	if !mi.healing {
+		return
+	}
+
+	if !t.IsCompleted() || strings.HasPrefix(t.State, "checking") {
+		mi.healSeen = true
+	} else if mi.healSeen || time.Since(mi.healTime) > grace {
+		mi.healing = false
+	}
+}
+
 // GetTorrent returns the enclosed torrent pointer
 func (j *CheckTorrent) GetTorrent() *Torrent {
 	return j.torrent
@@ -73,19 +130,48 @@ func (tm *TorrentQueue) setRemoveEvent(cb func(*Torrent)) {
 	tm.removed = cb
 }
 
-func (tm *TorrentQueue) setQueueFullEvent(cb func(*Torrent, TorrentJob)) {
-	tm.queuefull = cb
+func (tm *TorrentQueue) setIgnoreEvent(cb func(*Torrent)) {
+	tm.ignore = cb
+}
+
+func (tm *TorrentQueue) setCancelEvent(cb func(*Torrent, string)) {
+	tm.canceled = cb
+}
+
+func (tm *TorrentQueue) setPositionEvent(cb func(*Torrent, string, int, int)) {
+	tm.positioned = cb
+}
+
+func (tm *TorrentQueue) setWaitEvent(cb func(*Torrent, string)) {
+	tm.waited = cb
+}
+
+func (tm *TorrentQueue) setDeferEvent(cb func(string)) {
+	tm.deferring = cb
 }
 
 // NewTorrentQueue creates a new concurrent map to hold a torrent list
-func NewTorrentQueue(cfg *config) *TorrentQueue {
-	return &TorrentQueue{
+func NewTorrentQueue(cfg *config, store *stateStore) *TorrentQueue {
+	tm := &TorrentQueue{
 		data:   make(map[string]*mapItem),
-		queueA: make(chan TorrentJob, 100),
-		queueB: make(chan TorrentJob, 100),
+		queueA: newJobList("unpack", newDeviceSlots()),
+		queueB: newJobList("check", nil),
 		mutex:  sync.Mutex{},
 		config: cfg,
+		store:  store,
 	}
+	tm.queueA.deferral = tm.deferral
+	return tm
+}
+
+// SetConfig replaces the configuration after a reload, it is only read
+// while the queue is locked
+func (tm *TorrentQueue) SetConfig(cfg *config) {
+	tm.Lock()
+	defer tm.Unlock()
+	tm.config = cfg
+	tm.queueA.wake()
+	tm.queueB.wake()
 }
 
 // Lock the TorrentQueue mutex
@@ -102,7 +188,20 @@ func (tm *TorrentQueue) Unlock() {
 func (tm *TorrentQueue) Remove(hash string) {
 	tm.Lock()
 	defer tm.Unlock()
+	tm.remove(hash)
+}
+
+// remove deletes a torrent mapping and its pending jobs
+func (tm *TorrentQueue) remove(hash string) {
 	delete(tm.data, hash)
+	tm.queueA.remove(hash)
+	tm.queueB.remove(hash)
+}
+
+// Start hands the queued jobs to the workers until ctx is canceled
+func (tm *TorrentQueue) Start(ctx context.Context) {
+	go tm.feed(ctx, tm.queueA)
+	go tm.feed(ctx, tm.queueB)
 }
 
 // Get torrent data given a hash
@@ -119,77 +218,238 @@ func (tm *TorrentQueue) Get(hash string) *Torrent {
 func (tm *TorrentQueue) JobDone(hash string) {
 	tm.Lock()
 	defer tm.Unlock()
+	tm.queueA.release(hash)
 	if t, ok := tm.data[hash]; ok {
 		t.status = tsDefault
+		if t.cancel != nil {
+			t.cancel()
+			t.cancel = nil
+		}
+	}
+}
+
+// JobContext returns the context of a running job, which is canceled by
+// Update when the torrent leaves the busy category or is tagged to cancel
+// it. The context is released by JobDone.
+func (tm *TorrentQueue) JobContext(ctx context.Context, hash string) context.Context {
+	tm.Lock()
+	defer tm.Unlock()
+
+	jctx, cancel := context.WithCancel(ctx)
+	if t, ok := tm.data[hash]; ok {
+		t.cancel = cancel
+		t.busySeen = false
+	} else {
+		// The torrent is gone already
+		cancel()
+	}
+	return jctx
+}
+
+// cancelJob cancels the running job of a torrent
+func (tm *TorrentQueue) cancelJob(mi *mapItem, reason string) {
+	if mi.cancel == nil {
+		return
+	}
+
+	mi.cancel()
+	mi.cancel = nil
+	if tm.canceled != nil {
+		tm.canceled(mi.torrent, reason)
+	}
+}
+
+// checkCancel cancels the running job of a torrent when it's tagged to
+// cancel it, or when it left the busy category after it was seen in it
+func (tm *TorrentQueue) checkCancel(mi *mapItem, t *Torrent) {
+	if mi.cancel == nil {
+		return
+	}
+
+	if t.HasTag(tagCancel) {
+		tm.cancelJob(mi, "tagged "+tagCancel)
+	} else if t.Category == tm.config.Categories.UnpackBusy {
+		mi.busySeen = true
+	} else if mi.busySeen {
+		tm.cancelJob(mi, "category changed to "+t.Category)
+	}
+}
+
+// Running returns the number of jobs that were handed to the workers
+// and are not done yet
+func (tm *TorrentQueue) Running() int {
+	tm.Lock()
+	defer tm.Unlock()
+
+	n := 0
+	for _, mi := range tm.data {
+		if mi.IsQueued() {
+			n++
+		}
+	}
+	return n - len(tm.queueA.jobs) - len(tm.queueB.jobs)
+}
+
+// Heal starts a recheck attempt for a torrent with corrupt data. It returns
+// the attempt number, or zero if there are no attempts left.
+func (tm *TorrentQueue) Heal(hash string) uint {
+	tm.Lock()
+	defer tm.Unlock()
+	if t, ok := tm.data[hash]; ok && t.heals < tm.config.Heal.Attempts {
+		t.heals++
+		t.healing = true
+		t.healSeen = false
+		t.healTime = time.Now()
+		return t.heals
+	}
+	return 0
+}
+
+// Retry schedules another unpack attempt after a failure. It returns the
+// attempt number and the time to wait for it, or zero if there are no
+// attempts left.
+func (tm *TorrentQueue) Retry(hash string) (uint, time.Duration) {
+	tm.Lock()
+	defer tm.Unlock()
+	if t, ok := tm.data[hash]; ok && t.retries < tm.config.Retry.Attempts {
+		t.retries++
+		delay := tm.config.Retry.Delay(t.retries)
+		t.retryAt = time.Now().Add(delay)
+		return t.retries + 1, delay
+	}
+	return 0, 0
+}
+
+// RetryReset clears the retry attempts of a torrent
+func (tm *TorrentQueue) RetryReset(hash string) {
+	tm.Lock()
+	defer tm.Unlock()
+	if t, ok := tm.data[hash]; ok {
+		t.retries = 0
+		t.retryAt = time.Time{}
+	}
+}
+
+// Retries returns the number of retries of a torrent and when the next
+// one is due
+func (tm *TorrentQueue) Retries(hash string) (uint, time.Time) {
+	tm.Lock()
+	defer tm.Unlock()
+	if t, ok := tm.data[hash]; ok {
+		return t.retries, t.retryAt
+	}
+	return 0, time.Time{}
+}
+
+// Heals returns the number of recheck attempts of a torrent
+func (tm *TorrentQueue) Heals(hash string) uint {
+	tm.Lock()
+	defer tm.Unlock()
+	if t, ok := tm.data[hash]; ok {
+		return t.heals
 	}
+	return 0
 }
 
-// QueueA returns a queue of torrent jobs
+// HealReset clears the recheck attempts of a torrent
+func (tm *TorrentQueue) HealReset(hash string) {
+	tm.Lock()
+	defer tm.Unlock()
+	if t, ok := tm.data[hash]; ok {
+		t.heals = 0
+	}
+}
+
+// QueueA returns a queue of unpack jobs
 func (tm *TorrentQueue) QueueA() <-chan TorrentJob {
-	return tm.queueA
+	return tm.queueA.ch
 }
 
-// QueueB returns a queue of torrent jobs
+// QueueB returns a queue of check jobs
 func (tm *TorrentQueue) QueueB() <-chan TorrentJob {
-	return tm.queueB
+	return tm.queueB.ch
+}
+
+// isRecent returns true if the torrent completed after the cutoff
+func isRecent(t *Torrent, cutoff time.Time) bool {
+	return cutoff.IsZero() || !time.Unix(int64(t.CompletionOn), 0).Before(cutoff)
 }
 
 func (tm *TorrentQueue) enqeueJobs() {
+	cutoff := tm.config.CheckCutoff()
 	for _, mi := range tm.data {
+		if mi.missing > 0 {
+			// Missing from the last list, its state is out of date
+			continue
+		}
 
-		if mi.torrent.IsCompleted() && !mi.torrent.HasCategory() && !mi.IsQueued() {
+		if mi.torrent.IsCompleted() && !mi.torrent.HasCategory() && !mi.IsQueued() &&
+			!isRecent(mi.torrent, cutoff) {
+
+			// Torrents that completed before the cutoff are left alone,
+			// they can be checked with the backfill command
+			if !mi.ignored && tm.ignore != nil {
+				tm.ignore(mi.torrent)
+			}
+			mi.ignored = true
+
+		} else if mi.torrent.IsCompleted() && !mi.torrent.HasCategory() && !mi.IsQueued() {
 
 			// When the torrent is done, is not already in the queue
 			// and has no category, then queue it for a check
-			// TODO: Add UNIX time comparison to detect torrent age
-			torrentJob := &CheckTorrent{torrent: mi.torrent}
-
-			select {
-			case tm.queueB <- torrentJob:
-				mi.status = tsQueued
-				continue
-			default:
-				// QueueA is full
-				if tm.queuefull != nil {
-					tm.queuefull(mi.torrent, torrentJob)
-				}
-			}
+			tm.queueB.push(&CheckTorrent{torrent: mi.torrent, cleared: mi.cleared})
+			mi.status = tsQueued
+			mi.cleared = false
 
-		} else if mi.torrent.IsCompleted() && !mi.IsQueued() &&
+		} else if mi.torrent.IsCompleted() && !mi.IsQueued() && !mi.IsHealing() && !mi.IsWaiting() &&
 			mi.torrent.Category == tm.config.Categories.UnpackStart {
 
 			// When the torrent is done, is not already in the queue
 			// and the category is set to "Unpack", queue the torrent
 			// for an unpacking job
 
-			torrentJob := &UnpackTorrent{torrent: mi.torrent}
-
-			select {
-			case tm.queueA <- torrentJob:
-				mi.status = tsQueued
-				continue
-			default:
-				// QueueB is full
-				if tm.queuefull != nil {
-					tm.queuefull(mi.torrent, torrentJob)
-				}
-			}
+			tm.queueA.push(&UnpackTorrent{torrent: mi.torrent})
+			mi.status = tsQueued
+		} else if mi.torrent.IsCompleted() && !mi.IsQueued() && mi.orphan &&
+			mi.torrent.Category == tm.config.Categories.UnpackBusy {
+
+			// The torrent was being unpacked when the daemon stopped,
+			// queue it for an unpacking job that resumes the old one
+
+			tm.queueA.push(&UnpackTorrent{torrent: mi.torrent, resume: true})
+			mi.status = tsQueued
+			mi.orphan = false
 		}
 	}
 }
 
 // Update the torrent queue with a new torrent list
 func (tm *TorrentQueue) Update(torrents []*Torrent) {
+	report := func() {}
 	tm.Lock()
+	defer func() { report() }()
 	defer tm.Unlock()
 
+	// An empty list is ignored, qBittorrent may be starting up or a poll
+	// went wrong. Running jobs shouldn't be canceled because of it.
+	if len(torrents) == 0 {
+		return
+	}
+
 	// Check for new and updated torrents
 	now := time.Now()
 	for _, t := range torrents {
 		if meta, ok := tm.data[t.Hash]; ok {
-			// Existing torrent
+			// Existing torrent, one of which the category is removed
+			// is checked again
+			if meta.torrent.HasCategory() && !t.HasCategory() {
+				meta.cleared = true
+			}
 			meta.torrent = t
 			meta.time = now
+			meta.missing = 0
+			meta.updateHeal(t, 3*time.Duration(tm.config.Polling.Delay)*time.Second)
+			tm.checkCancel(meta, t)
 
 			// Callback
 			if tm.updated != nil {
@@ -197,13 +457,25 @@ func (tm *TorrentQueue) Update(torrents []*Torrent) {
 			}
 
 		} else {
-			// New torrent
-			tm.data[t.Hash] = &mapItem{
-				torrent: t,
-				status:  tsDefault,
-				time:    now,
+			// New torrent, one that is already busy unpacking was
+			// left behind by an earlier run of the daemon
+			mi := &mapItem{
+				torrent:  t,
+				status:   tsDefault,
+				time:     now,
+				orphan:   t.Category == tm.config.Categories.UnpackBusy,
+				waiting:  t.HasTag(tagWaiting),
+				position: queuePosition(t),
 			}
 
+			// Retries and recheck attempts continue where they were
+			// before a restart
+			if rec, ok := tm.store.Get(t.Hash); ok {
+				mi.retries, mi.retryAt = rec.Retries, rec.RetryAt
+				mi.heals = rec.Heals
+			}
+			tm.data[t.Hash] = mi
+
 			// Callback
 			if tm.added != nil {
 				tm.added(t)
@@ -211,11 +483,16 @@ func (tm *TorrentQueue) Update(torrents []*Torrent) {
 		}
 	}
 
-	// Check for removed torrents
+	// Check for removed torrents, a torrent has to be missing from
+	// several lists in a row for the same reason
 	for k, d := range tm.data {
-		if d.time.Before(now) {
+		if !d.time.Before(now) {
+			continue
+		}
+		if d.missing++; d.missing >= removedPolls {
 			d.status = tsRemoved
-			delete(tm.data, k)
+			tm.cancelJob(d, "removed from qBittorrent")
+			tm.remove(k)
 			if tm.removed != nil {
 				tm.removed(d.torrent)
 			}
@@ -224,4 +501,5 @@ func (tm *TorrentQueue) Update(torrents []*Torrent) {
 
 	// Check for and enqueue the wanted torrent jobs
 	tm.enqeueJobs()
+	report = tm.positions()
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Files written by qbdaemon into the destination of an unpack
+const (
+	unpackLogName    = "unpack.log"
+	unpackReportName = "unpack.json"
+)
+
+// targetReport describes the unpacking of a single archive set
+type targetReport struct {
+	Path      string    `json:"path"`
+	Format    string    `json:"format"`
+	Volumes   []string  `json:"volumes"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Bytes     int64     `json:"bytes"`
+	Status    int       `json:"exit_status"`
+	Error     string    `json:"error,omitempty"`
+	ErrorType string    `json:"error_type,omitempty"`
+
+	// The entries the target created in the destination, relative to it
+	created []string
+}
+
+// fileReport is a file in the destination after unpacking
+type fileReport struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// unpackReport is written as unpack.json next to unpack.log
+type unpackReport struct {
+	Hash      string          `json:"hash,omitempty"`
+	Name      string          `json:"name"`
+	Attempt   uint            `json:"attempt,omitempty"`
+	Dest      string          `json:"dest"`
+	Start     time.Time       `json:"start"`
+	End       time.Time       `json:"end"`
+	Error     string          `json:"error,omitempty"`
+	ErrorType string          `json:"error_type,omitempty"`
+	Targets   []*targetReport `json:"targets"`
+	Files     []fileReport    `json:"files"`
+}
+
+func newUnpackReport(hash, name, dest string) *unpackReport {
+	return &unpackReport{
+		Hash:    hash,
+		Name:    name,
+		Dest:    dest,
+		Start:   time.Now(),
+		Targets: []*targetReport{},
+		Files:   []fileReport{},
+	}
+}
+
+// addTarget records the result of unpacking a target
+func (r *unpackReport) addTarget(target *Target, start time.Time, ex *extracted, err error) {
+	tr := &targetReport{
+		Path:      target.String(),
+		Format:    target.Format(),
+		Volumes:   target.Volumes(),
+		Start:     start,
+		End:       time.Now(),
+		Bytes:     ex.bytes,
+		ErrorType: errorType(err),
+		created:   ex.paths,
+	}
+
+	if err != nil {
+		tr.Error = err.Error()
+		tr.Status = -1
+		if exit, ok := err.(*ExitError); ok {
+			tr.Status = exit.Status
+		}
+	}
+
+	r.Targets = append(r.Targets, tr)
+}
+
+// created returns the entries all targets of this run created in the
+// destination, targets that an earlier run unpacked aren't included
+func (r *unpackReport) created() []string {
+	var paths []string
+	for _, tr := range r.Targets {
+		paths = append(paths, tr.created...)
+	}
+	return paths
+}
+
+// finish sets the overall result and lists the unpacked files
+func (r *unpackReport) finish(err error) {
+	r.End = time.Now()
+	r.ErrorType = errorType(err)
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	filepath.Walk(r.Dest, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			rel, _ := filepath.Rel(r.Dest, path)
+			if !ownFile(rel) {
+				r.Files = append(r.Files, fileReport{Path: rel, Size: info.Size()})
+			}
+		}
+		return nil
+	})
+}
+
+// write saves the report as unpack.json in the destination
+func (r *unpackReport) write() error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(r.Dest, unpackReportName), data, 0644)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Actions of a rule
+const (
+	ruleUnpack = "unpack"
+	ruleSkip   = "skip"
+)
+
+// ruleMatcher is a rule from the 'rules' section of the config
+type ruleMatcher struct {
+	name     string
+	action   string
+	category *regexp.Regexp
+	tags     []string
+	tracker  *regexp.Regexp
+	savePath *regexp.Regexp
+	torrent  *regexp.Regexp
+	minSize  uint64
+	maxSize  uint64
+	archives *bool
+}
+
+// compileRule compiles an optional regular expression of a rule
+func compileRule(name, key, expr string) (*regexp.Regexp, error) {
+	if len(expr) == 0 {
+		return nil, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("rule %s has an invalid '%s'; %s", name, key, err.Error())
+	}
+	return re, nil
+}
+
+// newRule validates a rule from the config and creates it
+func newRule(r *rule) (*ruleMatcher, error) {
+	rm := &ruleMatcher{
+		name:     r.Name,
+		action:   r.Action,
+		tags:     r.Tags,
+		minSize:  r.MinSize,
+		maxSize:  r.MaxSize,
+		archives: r.Archives,
+	}
+
+	if len(rm.name) == 0 {
+		return nil, fmt.Errorf("rule is missing a 'name'")
+	}
+
+	if rm.action != ruleUnpack && rm.action != ruleSkip {
+		return nil, fmt.Errorf("rule %s 'action' must be %s or %s", rm.name, ruleUnpack, ruleSkip)
+	}
+
+	var err error
+	if rm.category, err = compileRule(rm.name, "category", r.Category); err != nil {
+		return nil, err
+	}
+	if rm.tracker, err = compileRule(rm.name, "tracker", r.Tracker); err != nil {
+		return nil, err
+	}
+	if rm.savePath, err = compileRule(rm.name, "save_path", r.SavePath); err != nil {
+		return nil, err
+	}
+	if rm.torrent, err = compileRule(rm.name, "torrent", r.Torrent); err != nil {
+		return nil, err
+	}
+
+	return rm, nil
+}
+
+// Match checks a torrent that was given category by the check, and
+// returns what matched or false if the rule doesn't apply
+func (rm *ruleMatcher) Match(t *Torrent, category string, archives bool) (string, bool) {
+	var matched []string
+
+	if rm.category != nil {
+		if !rm.category.MatchString(category) {
+			return "", false
+		}
+		matched = append(matched, "category")
+	}
+
+	for _, tag := range rm.tags {
+		if !t.HasTag(tag) {
+			return "", false
+		}
+	}
+	if len(rm.tags) > 0 {
+		matched = append(matched, "tags")
+	}
+
+	if rm.tracker != nil {
+		if !rm.tracker.MatchString(t.Tracker) {
+			return "", false
+		}
+		matched = append(matched, "tracker")
+	}
+
+	if rm.savePath != nil {
+		if !rm.savePath.MatchString(t.SavePath) {
+			return "", false
+		}
+		matched = append(matched, "save path")
+	}
+
+	if rm.torrent != nil {
+		if !rm.torrent.MatchString(t.Name) {
+			return "", false
+		}
+		matched = append(matched, "name")
+	}
+
+	if rm.minSize > 0 || rm.maxSize > 0 {
+		if t.Size < rm.minSize || (rm.maxSize > 0 && t.Size > rm.maxSize) {
+			return "", false
+		}
+		matched = append(matched, "size")
+	}
+
+	if rm.archives != nil {
+		if *rm.archives != archives {
+			return "", false
+		}
+		matched = append(matched, "archives")
+	}
+
+	if len(matched) == 0 {
+		return "rule " + rm.name, true
+	}
+	return fmt.Sprintf("rule %s (%s)", rm.name, strings.Join(matched, ", ")), true
+}
+
+// applyRules returns the action of the first rule that matches a torrent
+// and the reason for it, or an empty action if no rule matches
+func applyRules(rules []*ruleMatcher, t *Torrent, category string, archives bool) (string, string) {
+	for _, rm := range rules {
+		if reason, ok := rm.Match(t, category, archives); ok {
+			return rm.action, reason
+		}
+	}
+	return "", "no rule matched"
+}
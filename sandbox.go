@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+)
+
+// sandboxArg is the hidden first argument that makes qbdaemon act as
+// a sandbox helper: qbdaemon -sandbox-exec <src> <dest> -- <tool> [args...]
+const sandboxArg = "-sandbox-exec"
+
+// sandbox restricts external extractor processes. A nil
+// sandbox runs the tools with the daemon's own privileges.
+type sandbox struct {
+	self       string
+	landlock   int
+	namespaces bool
+}
+
+// Command returns a command that runs the named tool, restricted to
+// reading src and writing dest. An empty dest denies all writes.
+func (sb *sandbox) Command(ctx context.Context, src, dest, name string, args ...string) *exec.Cmd {
+	if sb == nil {
+		return exec.CommandContext(ctx, name, args...)
+	}
+	return sb.command(ctx, src, dest, name, args...)
+}
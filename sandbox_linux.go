@@ -0,0 +1,286 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// Landlock system calls and flags, see linux/landlock.h
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockCreateRulesetVersion = 1 << 0
+	landlockRulePathBeneath      = 1
+
+	llExecute    = 1 << 0
+	llWriteFile  = 1 << 1
+	llReadFile   = 1 << 2
+	llReadDir    = 1 << 3
+	llRemoveDir  = 1 << 4
+	llRemoveFile = 1 << 5
+	llMakeChar   = 1 << 6
+	llMakeDir    = 1 << 7
+	llMakeReg    = 1 << 8
+	llMakeSock   = 1 << 9
+	llMakeFifo   = 1 << 10
+	llMakeBlock  = 1 << 11
+	llMakeSym    = 1 << 12
+	llRefer      = 1 << 13
+	llTruncate   = 1 << 14
+	llIoctlDev   = 1 << 15
+
+	llBindTCP    = 1 << 0
+	llConnectTCP = 1 << 1
+
+	// Access rights that can be granted on a regular file
+	llFileAccess = llExecute | llWriteFile | llReadFile | llTruncate | llIoctlDev
+
+	prSetNoNewPrivs = 38
+
+	oPath = 0x200000
+)
+
+// Paths the extractors need for loading themselves and their libraries
+var sandboxSystemPaths = []string{
+	"/bin", "/sbin", "/usr", "/lib", "/lib32", "/lib64",
+	"/etc/ld.so.cache", "/etc/ld.so.conf", "/etc/ld.so.conf.d",
+	"/etc/localtime", "/etc/nsswitch.conf", "/etc/passwd", "/etc/group",
+}
+
+type landlockRulesetAttr struct {
+	handledAccessFS  uint64
+	handledAccessNet uint64
+}
+
+// Matches the packed kernel struct, parentFd ends at byte 12
+type landlockPathBeneathAttr struct {
+	allowedAccess uint64
+	parentFd      int32
+}
+
+// landlockABI returns the Landlock ABI version supported by the kernel, or 0
+func landlockABI() int {
+	abi, _, errno := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+	if errno != 0 {
+		return 0
+	}
+	return int(abi)
+}
+
+func landlockHandledFS(abi int) uint64 {
+	access := uint64(llExecute | llWriteFile | llReadFile | llReadDir |
+		llRemoveDir | llRemoveFile | llMakeChar | llMakeDir | llMakeReg |
+		llMakeSock | llMakeFifo | llMakeBlock | llMakeSym)
+	if abi >= 2 {
+		access |= llRefer
+	}
+	if abi >= 3 {
+		access |= llTruncate
+	}
+	if abi >= 5 {
+		access |= llIoctlDev
+	}
+	return access
+}
+
+func newSandbox(cfg *sandboxing) *sandbox {
+	if cfg == nil || (!cfg.Landlock && !cfg.Namespaces) {
+		return nil
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		log.Printf("[Sandbox] Warning: sandbox disabled, executable not found; %s", err.Error())
+		return nil
+	}
+
+	sb := &sandbox{self: self}
+
+	if cfg.Landlock {
+		if sb.landlock = landlockABI(); sb.landlock == 0 {
+			log.Println("[Sandbox] Warning: kernel lacks Landlock support, extractors can access the whole filesystem")
+		}
+	}
+
+	if cfg.Namespaces {
+		probe := exec.Command(self, sandboxArg)
+		sb.setNamespaces(probe)
+		if err := probe.Run(); err != nil {
+			log.Printf("[Sandbox] Warning: user namespaces unavailable, extractors have network access; %s", err.Error())
+		} else {
+			sb.namespaces = true
+		}
+	}
+
+	if sb.landlock == 0 && !sb.namespaces {
+		return nil
+	}
+
+	if !sb.namespaces && sb.landlock < 4 {
+		log.Println("[Sandbox] Warning: network access of extractors is not restricted")
+	}
+
+	return sb
+}
+
+// setNamespaces runs the command in a new user and network namespace,
+// the daemon's user and group are mapped to root inside of it
+func (sb *sandbox) setNamespaces(tool *exec.Cmd) {
+	tool.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNET,
+		UidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: os.Getuid(), Size: 1},
+		},
+		GidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: os.Getgid(), Size: 1},
+		},
+	}
+}
+
+func (sb *sandbox) command(ctx context.Context, src, dest, name string, args ...string) *exec.Cmd {
+	var tool *exec.Cmd
+
+	if sb.landlock > 0 {
+		path, err := exec.LookPath(name)
+		if err != nil {
+			path = name
+		}
+		helper := append([]string{sandboxArg, src, dest, "--", path}, args...)
+		tool = exec.CommandContext(ctx, sb.self, helper...)
+	} else {
+		tool = exec.CommandContext(ctx, name, args...)
+	}
+
+	if sb.namespaces {
+		sb.setNamespaces(tool)
+	}
+
+	return tool
+}
+
+// addPathRule allows access below path, missing paths are ignored
+func addPathRule(ruleset int, path string, access uint64) error {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if !fi.IsDir() {
+		access &= llFileAccess
+	}
+
+	fd, err := syscall.Open(path, oPath|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	attr := landlockPathBeneathAttr{allowedAccess: access, parentFd: int32(fd)}
+	_, _, errno := syscall.Syscall6(sysLandlockAddRule, uintptr(ruleset),
+		landlockRulePathBeneath, uintptr(unsafe.Pointer(&attr)), 0, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("landlock rule for %s; %s", path, errno.Error())
+	}
+	return nil
+}
+
+// landlockRestrict confines the current thread to reading src and
+// the system paths, writing dest and, when supported, denies TCP
+func landlockRestrict(src, dest string) error {
+	abi := landlockABI()
+	if abi == 0 {
+		return fmt.Errorf("landlock not supported")
+	}
+
+	handled := landlockHandledFS(abi)
+	attr := landlockRulesetAttr{handledAccessFS: handled}
+	size := unsafe.Sizeof(attr.handledAccessFS)
+	if abi >= 4 {
+		attr.handledAccessNet = llBindTCP | llConnectTCP
+		size = unsafe.Sizeof(attr)
+	}
+
+	fd, _, errno := syscall.Syscall(sysLandlockCreateRuleset,
+		uintptr(unsafe.Pointer(&attr)), size, 0)
+	if errno != 0 {
+		return fmt.Errorf("landlock ruleset; %s", errno.Error())
+	}
+	ruleset := int(fd)
+	defer syscall.Close(ruleset)
+
+	readOnly := uint64(llExecute | llReadFile | llReadDir)
+	for _, path := range sandboxSystemPaths {
+		if err := addPathRule(ruleset, path, readOnly); err != nil {
+			return err
+		}
+	}
+
+	// The source may be a single archive or a wildcard, allow its
+	// directory so that the following volumes can be opened as well
+	if fi, err := os.Stat(src); err != nil || !fi.IsDir() {
+		src = filepath.Dir(src)
+	}
+	if err := addPathRule(ruleset, src, llReadFile|llReadDir); err != nil {
+		return err
+	}
+
+	// No devices, sockets or fifos in the destination
+	if len(dest) > 0 {
+		write := handled &^ (llExecute | llMakeChar | llMakeBlock | llMakeSock | llMakeFifo | llIoctlDev)
+		if err := addPathRule(ruleset, dest, write); err != nil {
+			return err
+		}
+	}
+
+	if _, _, errno := syscall.Syscall6(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0, 0, 0, 0); errno != 0 {
+		return fmt.Errorf("no_new_privs; %s", errno.Error())
+	}
+
+	if _, _, errno := syscall.Syscall(sysLandlockRestrictSelf, uintptr(ruleset), 0, 0); errno != 0 {
+		return fmt.Errorf("landlock restrict; %s", errno.Error())
+	}
+
+	return nil
+}
+
+// runSandboxed is the entry point of the sandbox helper, it applies
+// Landlock to itself and replaces itself with the extractor. It never
+// returns. Without arguments it only tests that it could be started.
+func runSandboxed(args []string) {
+	if len(args) == 0 {
+		os.Exit(0)
+	}
+
+	if len(args) < 4 || args[2] != "--" {
+		fmt.Fprintln(os.Stderr, "sandbox: invalid arguments")
+		os.Exit(2)
+	}
+
+	src, dest, tool := args[0], args[1], args[3:]
+
+	// Landlock and no_new_privs apply to the calling thread only,
+	// which must therefore be the one that calls execve
+	runtime.LockOSThread()
+
+	if err := landlockRestrict(src, dest); err != nil {
+		fmt.Fprintln(os.Stderr, "sandbox:", err)
+		os.Exit(2)
+	}
+
+	err := syscall.Exec(tool[0], tool, os.Environ())
+	fmt.Fprintln(os.Stderr, "sandbox:", err)
+	os.Exit(2)
+}
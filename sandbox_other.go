@@ -0,0 +1,27 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+)
+
+func newSandbox(cfg *sandboxing) *sandbox {
+	if cfg != nil && (cfg.Landlock || cfg.Namespaces) {
+		log.Println("[Sandbox] Warning: sandboxing is only supported on Linux")
+	}
+	return nil
+}
+
+func (sb *sandbox) command(ctx context.Context, src, dest, name string, args ...string) *exec.Cmd {
+	return exec.CommandContext(ctx, name, args...)
+}
+
+func runSandboxed(args []string) {
+	fmt.Fprintln(os.Stderr, "sandbox: not supported on this platform")
+	os.Exit(2)
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Orders in which queued jobs are started
+const (
+	orderFIFO     = "fifo"
+	orderSmallest = "smallest"
+	orderOldest   = "oldest"
+)
+
+// Tags that raise or lower the priority of a torrent
+const (
+	tagPrioHigh = "qbd:prio=high"
+	tagPrioLow  = "qbd:prio=low"
+)
+
+// The tag that shows the position of a torrent in its queue
+const tagQueue = "qbd:queue="
+
+// queueTag returns the tag for a queue position
+func queueTag(position int) string {
+	return fmt.Sprintf("%s%d", tagQueue, position)
+}
+
+// queuePosition returns the position a torrent is tagged with, for tags
+// left behind by an earlier run of the daemon
+func queuePosition(t *Torrent) int {
+	for _, tag := range strings.Split(t.Tags, ",") {
+		tag = strings.TrimSpace(tag)
+		if strings.HasPrefix(tag, tagQueue) {
+			if n, err := strconv.Atoi(tag[len(tagQueue):]); err == nil {
+				return n
+			}
+		}
+	}
+	return 0
+}
+
+// positionChange is a torrent of which the queue position changed, a
+// position of 0 means it left the queue
+type positionChange struct {
+	torrent  *Torrent
+	queue    string
+	old      int
+	position int
+}
+
+// pendingJob is a job waiting in a job list
+type pendingJob struct {
+	job      TorrentJob
+	queued   time.Time
+	devices  []uint64
+	resolved bool
+}
+
+// jobList holds the pending jobs of one job type. It is unbounded, and
+// the jobs are handed to the workers in the configured order. The jobs of
+// a list with device slots only start when their devices have a free slot,
+// and none start while the deferral of the list returns a reason.
+type jobList struct {
+	name     string
+	jobs     []*pendingJob
+	ch       chan TorrentJob
+	added    chan struct{}
+	slots    *deviceSlots
+	deferral func() (string, string)
+	deferred string
+}
+
+// waitChange is a torrent that started or stopped waiting because the
+// jobs of its list are deferred, with the reason while it waits
+type waitChange struct {
+	torrent *Torrent
+	reason  string
+}
+
+func newJobList(name string, slots *deviceSlots) *jobList {
+	return &jobList{
+		name:  name,
+		ch:    make(chan TorrentJob),
+		added: make(chan struct{}),
+		slots: slots,
+	}
+}
+
+// push adds a job and wakes up the feeder of the list
+func (jl *jobList) push(job TorrentJob) {
+	jl.jobs = append(jl.jobs, &pendingJob{job: job, queued: time.Now()})
+	jl.wake()
+}
+
+// wake makes the feeder of the list choose the next job again
+func (jl *jobList) wake() {
+	close(jl.added)
+	jl.added = make(chan struct{})
+}
+
+// next returns the first pending job that can start, jobs of which the
+// devices aren't known yet are skipped
+func (jl *jobList) next(cfg *config) *pendingJob {
+	for _, pj := range jl.jobs {
+		if jl.slots == nil {
+			return pj
+		}
+		if pj.resolved && jl.slots.free(cfg, pj.devices) {
+			return pj
+		}
+	}
+	return nil
+}
+
+// unresolved returns the pending jobs of which the devices aren't known
+func (jl *jobList) unresolved() []*pendingJob {
+	var jobs []*pendingJob
+	if jl.slots != nil {
+		for _, pj := range jl.jobs {
+			if !pj.resolved {
+				jobs = append(jobs, pj)
+			}
+		}
+	}
+	return jobs
+}
+
+// release frees the device slots of a job that ended
+func (jl *jobList) release(hash string) {
+	if jl.slots != nil && jl.slots.release(hash) {
+		jl.wake()
+	}
+}
+
+// remove drops the pending job of a torrent
+func (jl *jobList) remove(hash string) {
+	for i, pj := range jl.jobs {
+		if pj.job.GetTorrent().Hash == hash {
+			jl.jobs = append(jl.jobs[:i], jl.jobs[i+1:]...)
+			return
+		}
+	}
+}
+
+// deferJobs checks whether the jobs of the list may start, and marks the
+// torrents of the pending jobs as waiting while they may not. It returns
+// true while the jobs are deferred, and a function that reports the
+// changes once the queue is unlocked.
+func (tm *TorrentQueue) deferJobs(jl *jobList) (bool, func()) {
+	var kind, reason string
+	if jl.deferral != nil {
+		kind, reason = jl.deferral()
+	}
+	deferred := len(kind) > 0
+	changed := kind != jl.deferred
+	jl.deferred = kind
+
+	var waits []waitChange
+	for _, pj := range jl.jobs {
+		mi, ok := tm.data[pj.job.GetTorrent().Hash]
+		if ok && mi.waiting != deferred {
+			mi.waiting = deferred
+			waits = append(waits, waitChange{torrent: mi.torrent, reason: reason})
+		}
+	}
+
+	return deferred, func() {
+		if changed && tm.deferring != nil {
+			tm.deferring(reason)
+		}
+		for _, wc := range waits {
+			if tm.waited != nil {
+				tm.waited(wc.torrent, wc.reason)
+			}
+		}
+	}
+}
+
+// prio returns the priority of a torrent from its tags
+func prio(t *Torrent) int {
+	if t.HasTag(tagPrioHigh) {
+		return 1
+	} else if t.HasTag(tagPrioLow) {
+		return -1
+	}
+	return 0
+}
+
+// sort orders the pending jobs by the current state of their torrents in
+// data. Jobs that waited longer than maxWait go first so no job is starved,
+// then jobs with a higher priority tag, and then the configured order.
+func (jl *jobList) sort(data map[string]*mapItem, order string, maxWait time.Duration) {
+	now := time.Now()
+	overdue := func(pj *pendingJob) bool {
+		return maxWait > 0 && now.Sub(pj.queued) > maxWait
+	}
+	torrent := func(pj *pendingJob) *Torrent {
+		if mi, ok := data[pj.job.GetTorrent().Hash]; ok {
+			return mi.torrent
+		}
+		return pj.job.GetTorrent()
+	}
+
+	sort.SliceStable(jl.jobs, func(i, j int) bool {
+		a, b := jl.jobs[i], jl.jobs[j]
+		if oa, ob := overdue(a), overdue(b); oa != ob {
+			return oa
+		} else if oa {
+			return a.queued.Before(b.queued)
+		}
+
+		ta, tb := torrent(a), torrent(b)
+		if pa, pb := prio(ta), prio(tb); pa != pb {
+			return pa > pb
+		}
+
+		switch order {
+		case orderSmallest:
+			if ta.Size != tb.Size {
+				return ta.Size < tb.Size
+			}
+		case orderOldest:
+			if ta.CompletionOn != tb.CompletionOn {
+				return ta.CompletionOn < tb.CompletionOn
+			}
+		}
+		return a.queued.Before(b.queued)
+	})
+}
+
+// feed hands the best pending job of a list to the next free worker. The
+// choice is made again whenever a job is added while the workers are busy.
+func (tm *TorrentQueue) feed(ctx context.Context, jl *jobList) {
+
+	// Sort again now and then, as waiting jobs become overdue and the
+	// reasons to defer them pass
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		// Devices are looked up without holding the lock, a stat of a
+		// network share that went away can take long
+		tm.Lock()
+		cfg := tm.config
+		pending := jl.unresolved()
+		tm.Unlock()
+		devices := make([][]uint64, len(pending))
+		for i, pj := range pending {
+			devices[i] = jobDevices(cfg, pj.job.GetTorrent())
+		}
+
+		tm.Lock()
+		for i, pj := range pending {
+			pj.devices, pj.resolved = devices[i], true
+		}
+		maxWait := time.Duration(tm.config.Scheduler.MaxWait) * time.Minute
+		jl.sort(tm.data, tm.config.Scheduler.Order, maxWait)
+		var next *pendingJob
+		deferred, report := tm.deferJobs(jl)
+		if !deferred {
+			next = jl.next(tm.config)
+		}
+		if next != nil && jl.slots != nil {
+			// The slots are taken before the job is handed over, as the
+			// worker may be done with it and release them right away
+			jl.slots.acquire(next.job.GetTorrent().Hash, next.devices)
+		}
+		added := jl.added
+		resolve := len(jl.unresolved()) > 0
+		tm.Unlock()
+		report()
+
+		if next == nil {
+			if resolve {
+				// Jobs were added while the devices were looked up
+				continue
+			}
+			select {
+			case <-added:
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		hash := next.job.GetTorrent().Hash
+		select {
+		case jl.ch <- next.job:
+			// The jobs behind it move up
+			tm.Lock()
+			jl.remove(hash)
+			report := tm.positions()
+			tm.Unlock()
+			report()
+			continue
+		case <-added:
+		case <-ticker.C:
+		case <-ctx.Done():
+		}
+
+		// No worker took the job, so it gives its slots back
+		tm.Lock()
+		if jl.slots != nil {
+			jl.slots.release(hash)
+		}
+		tm.Unlock()
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// positions updates the queue position of the torrents in both lists,
+// torrents that are no longer queued lose theirs. It returns a function
+// that reports the changes once the queue is unlocked.
+func (tm *TorrentQueue) positions() func() {
+	var changes []positionChange
+	queued := make(map[string]bool)
+	maxWait := time.Duration(tm.config.Scheduler.MaxWait) * time.Minute
+	for _, jl := range []*jobList{tm.queueA, tm.queueB} {
+		jl.sort(tm.data, tm.config.Scheduler.Order, maxWait)
+		for i, pj := range jl.jobs {
+			hash := pj.job.GetTorrent().Hash
+			queued[hash] = true
+			if mi, ok := tm.data[hash]; ok && mi.position != i+1 {
+				changes = append(changes, positionChange{mi.torrent, jl.name, mi.position, i + 1})
+				mi.position = i + 1
+			}
+		}
+	}
+	for hash, mi := range tm.data {
+		if mi.position != 0 && !queued[hash] {
+			changes = append(changes, positionChange{mi.torrent, "", mi.position, 0})
+			mi.position = 0
+		}
+	}
+
+	return func() {
+		for _, pc := range changes {
+			if tm.positioned != nil {
+				tm.positioned(pc.torrent, pc.queue, pc.old, pc.position)
+			}
+		}
+	}
+}
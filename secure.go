@@ -0,0 +1,424 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SecurityError is returned when an archive entry or an extracted
+// file would end up outside of the destination directory
+type SecurityError struct {
+	Path   string
+	Reason string
+}
+
+func (e *SecurityError) Error() string {
+	return fmt.Sprintf("security violation: %s (%s)", e.Reason, e.Path)
+}
+
+// unpackStagingName is the directory in the destination that a target is
+// extracted into before it is verified and moved into place
+const unpackStagingName = ".unpack.staging"
+
+// Maximum number of symlinks followed to resolve a path in an archive
+const maxLinks = 40
+
+// isAbsName returns true if an archive entry name or link target is an
+// absolute path, on any system. Windows archives use backslashes.
+func isAbsName(name string) bool {
+	slashed := strings.Replace(name, "\\", "/", -1)
+	return strings.HasPrefix(slashed, "/") || filepath.IsAbs(name) ||
+		(len(slashed) > 1 && slashed[1] == ':')
+}
+
+// checkEntryName validates an archive entry name before extraction
+func checkEntryName(name string) error {
+
+	// Archives created on Windows use backslashes
+	slashed := strings.Replace(name, "\\", "/", -1)
+
+	if isAbsName(name) {
+		return &SecurityError{Path: name, Reason: "absolute path"}
+	}
+
+	for _, part := range strings.Split(slashed, "/") {
+		if part == ".." {
+			return &SecurityError{Path: name, Reason: "parent directory reference"}
+		}
+	}
+
+	return nil
+}
+
+// entryParts splits an archive entry name or link target into its parts,
+// leaving out empty and '.' parts
+func entryParts(name string) []string {
+	var parts []string
+	for _, part := range strings.Split(strings.Replace(name, "\\", "/", -1), "/") {
+		if len(part) > 0 && part != "." {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// archiveLinks holds the symlinks an archive creates, by entry path
+type archiveLinks map[string]string
+
+// resolve follows the symlinks of the archive through a path relative to
+// the destination and returns false if it leads outside of it. Names are
+// resolved one part at a time, so 'link/..' is the parent of the target
+// of the link and not the directory the link is in.
+func (links archiveLinks) resolve(parts []string) ([]string, bool) {
+	followed := 0
+	return links.follow(parts, &followed)
+}
+
+func (links archiveLinks) follow(parts []string, followed *int) ([]string, bool) {
+	var resolved []string
+	for _, part := range parts {
+		if part == ".." {
+			if len(resolved) == 0 {
+				return nil, false
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+
+		resolved = append(resolved, part)
+		target, ok := links[strings.Join(resolved, "/")]
+		if !ok {
+			continue
+		}
+
+		// Loops are treated as leading outside
+		if *followed++; *followed > maxLinks || isAbsName(target) {
+			return nil, false
+		}
+		next := append(resolved[:len(resolved)-1:len(resolved)-1], entryParts(target)...)
+		if resolved, ok = links.follow(next, followed); !ok {
+			return nil, false
+		}
+	}
+	return resolved, true
+}
+
+// checkEntries validates the entries of an archive before extraction.
+// Besides the names it checks the targets of links and that no entry is
+// written through a symlink of the archive that points outside of the
+// destination, which the walk afterwards would be too late to catch.
+func checkEntries(entries []Entry) error {
+	links := make(archiveLinks)
+	for _, e := range entries {
+		if err := checkEntryName(e.Name); err != nil {
+			return err
+		}
+		if len(e.Link) > 0 && !e.Hard {
+			links[strings.Join(entryParts(e.Name), "/")] = e.Link
+		}
+	}
+
+	for _, e := range entries {
+		parts := entryParts(e.Name)
+		if len(parts) == 0 {
+			continue
+		}
+		dir := parts[:len(parts)-1]
+		if _, ok := links.resolve(dir); !ok {
+			return &SecurityError{Path: e.Name, Reason: "entry is written through a symlink pointing outside destination"}
+		}
+
+		switch {
+		case len(e.Link) == 0:
+		case e.Hard:
+			if _, ok := links.resolve(entryParts(e.Link)); !ok || isAbsName(e.Link) {
+				return &SecurityError{Path: e.Name, Reason: "hardlink to file outside destination"}
+			}
+		default:
+			target := append(dir[:len(dir):len(dir)], entryParts(e.Link)...)
+			if _, ok := links.resolve(target); !ok || isAbsName(e.Link) {
+				return &SecurityError{Path: e.Name, Reason: "symlink points outside destination"}
+			}
+		}
+	}
+
+	return nil
+}
+
+// newStaging creates an empty staging directory in the destination,
+// one that was left behind by a crash is removed first
+func newStaging(dest string) (string, error) {
+	staging := filepath.Join(dest, unpackStagingName)
+	if err := os.RemoveAll(staging); err != nil {
+		return "", err
+	}
+	return staging, os.MkdirAll(staging, 0700)
+}
+
+// mergeTree moves the entries of src into dest. Directories that are in
+// both are merged, files and links in dest are replaced like extractors
+// overwrite them.
+func mergeTree(src, dest string) error {
+	infos, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		from := filepath.Join(src, info.Name())
+		to := filepath.Join(dest, info.Name())
+
+		old, err := os.Lstat(to)
+		switch {
+		case err != nil:
+			if !os.IsNotExist(err) {
+				return err
+			}
+		case old.IsDir() && info.IsDir():
+			if err := mergeTree(from, to); err != nil {
+				return err
+			}
+			continue
+		case old.IsDir():
+			return fmt.Errorf("can't replace directory '%s' with a file", to)
+		case info.IsDir():
+			// Renaming a directory doesn't replace a file
+			if err := os.Remove(to); err != nil {
+				return err
+			}
+		}
+
+		if err := os.Rename(from, to); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isWithin returns true if path is equal to or below root
+func isWithin(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+type linkCount struct {
+	path  string
+	nlink uint64
+	seen  uint64
+}
+
+// treeEntry identifies a file in a snapshot of a directory tree
+type treeEntry struct {
+	mode    os.FileMode
+	modTime time.Time
+	inode   inode
+}
+
+// treeSnapshot holds the entries of a directory tree by relative path
+type treeSnapshot map[string]treeEntry
+
+func newTreeEntry(info os.FileInfo) treeEntry {
+	key, _, _ := fileInode(info)
+	return treeEntry{mode: info.Mode().Type(), modTime: info.ModTime(), inode: key}
+}
+
+// snapshotTree records the entries of dest before something is extracted
+// into it. A destination that doesn't exist yet has no entries.
+func snapshotTree(dest string) (treeSnapshot, error) {
+	snap := make(treeSnapshot)
+	err := filepath.Walk(dest, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == dest {
+				return nil
+			}
+			return err
+		}
+		if rel, err := filepath.Rel(dest, path); err == nil {
+			snap[rel] = newTreeEntry(info)
+		}
+		return nil
+	})
+	return snap, err
+}
+
+// changed returns true if the entry at rel was created or replaced since
+// the snapshot was taken
+func (snap treeSnapshot) changed(rel string, info os.FileInfo) bool {
+	old, ok := snap[rel]
+	if !ok {
+		return true
+	}
+	entry := newTreeEntry(info)
+	if old.mode != entry.mode {
+		return true
+	}
+	if old.inode != (inode{}) {
+		return old.inode != entry.inode
+	}
+	// Without inodes a directory that is still there is the same one,
+	// as its time changes whenever something is extracted into it
+	return !entry.mode.IsDir() && !old.modTime.Equal(entry.modTime)
+}
+
+// extracted lists the entries an archive created or replaced in the
+// destination, relative to it, and the total size of its files
+type extracted struct {
+	paths []string
+	bytes int64
+}
+
+// add records an extracted entry, the destination itself and the files
+// qbdaemon writes into it are left out
+func (ex *extracted) add(rel string, info os.FileInfo) {
+	if rel == "." || ownFile(rel) {
+		return
+	}
+	ex.paths = append(ex.paths, rel)
+	if info.Mode().IsRegular() {
+		ex.bytes += info.Size()
+	}
+}
+
+// diff returns the entries of dest that were created or replaced since
+// the snapshot was taken
+func (snap treeSnapshot) diff(dest string) *extracted {
+	ex := &extracted{}
+	filepath.Walk(dest, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if rel, err := filepath.Rel(dest, path); err == nil && snap.changed(rel, info) {
+			ex.add(rel, info)
+		}
+		return nil
+	})
+	return ex
+}
+
+// verifyTree walks an extraction destination and makes sure nothing that
+// was extracted into it refers to a location outside of it. Entries that
+// were already in the snapshot taken before are left alone. Offending
+// entries are removed and the first violation is returned as a
+// *SecurityError. The entries that were extracted and kept are returned.
+func verifyTree(dest string, before treeSnapshot) (*extracted, error) {
+	ex := &extracted{}
+
+	root, err := filepath.Abs(dest)
+	if err != nil {
+		return ex, err
+	}
+
+	// The destination itself may live behind a symlink
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return ex, err
+	}
+
+	var violation *SecurityError
+	var remove []string
+	links := make(map[inode]*linkCount)
+	added := make(map[string]os.FileInfo)
+	var order []string
+
+	fail := func(path, reason string) {
+		if violation == nil {
+			violation = &SecurityError{Path: path, Reason: reason}
+		}
+		remove = append(remove, path)
+	}
+
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		isNew := before.changed(rel, info)
+		if isNew {
+			added[path] = info
+			order = append(order, path)
+		}
+
+		mode := info.Mode()
+		switch {
+		case !isNew && !mode.IsRegular():
+			// Left alone, but hardlinks to new files are counted below
+
+		case mode&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(path), target)
+			}
+			if !isWithin(root, filepath.Clean(target)) {
+				fail(path, "symlink points outside destination")
+			} else if real, err := filepath.EvalSymlinks(path); err == nil && !isWithin(realRoot, real) {
+				fail(path, "symlink resolves outside destination")
+			}
+
+		case mode&(os.ModeDevice|os.ModeCharDevice|os.ModeNamedPipe|os.ModeSocket) != 0:
+			fail(path, "special file")
+
+		case mode.IsRegular():
+			if key, nlink, ok := fileInode(info); ok && nlink > 1 {
+				lc, ok := links[key]
+				if !ok {
+					lc = &linkCount{nlink: nlink}
+					links[key] = lc
+				}
+				lc.seen++
+				if isNew && len(lc.path) == 0 {
+					lc.path = path
+				}
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return ex, err
+	}
+
+	// A new hardlink with more names than we found below the
+	// destination shares its data with a file outside of it
+	for _, lc := range links {
+		if len(lc.path) > 0 && lc.seen < lc.nlink {
+			fail(lc.path, "hardlink to file outside destination")
+		}
+	}
+
+	for _, path := range remove {
+		os.Remove(path)
+		delete(added, path)
+	}
+
+	for _, path := range order {
+		if info, ok := added[path]; ok {
+			rel, _ := filepath.Rel(root, path)
+			ex.add(rel, info)
+		}
+	}
+
+	if violation != nil {
+		return ex, violation
+	}
+	return ex, nil
+}
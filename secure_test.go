@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckEntryName(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"a.txt", true},
+		{"dir/a.txt", true},
+		{"dir\\a.txt", true},
+		{"./dir/./a.txt", true},
+		{"..foo", true},
+		{"dir/..foo/a..txt", true},
+		{"dir/", true},
+		{"..", false},
+		{"../a.txt", false},
+		{"dir/../../a.txt", false},
+		{"dir/..", false},
+		{"a\\..\\b", false},
+		{"..\\a.txt", false},
+		{"/etc/passwd", false},
+		{"\\a.txt", false},
+		{"C:\\a.txt", false},
+		{"c:a.txt", false},
+	}
+
+	for _, test := range tests {
+		err := checkEntryName(test.name)
+		if test.ok && err != nil {
+			t.Errorf("checkEntryName(%q) = %v, want nil", test.name, err)
+		}
+		var se *SecurityError
+		if !test.ok && !errors.As(err, &se) {
+			t.Errorf("checkEntryName(%q) = %v, want a security error", test.name, err)
+		}
+	}
+}
+
+func TestCheckEntries(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []Entry
+		reason  string
+	}{
+		{"files", []Entry{{Name: "a.txt"}, {Name: "dir/b.txt"}}, ""},
+		{"bad name", []Entry{{Name: "a.txt"}, {Name: "../b.txt"}}, "parent directory reference"},
+		{"symlink", []Entry{{Name: "dir/a.txt"}, {Name: "link", Link: "dir/a.txt"}}, ""},
+		{"symlink up", []Entry{{Name: "dir/sub/link", Link: "../../a.txt"}}, ""},
+		{"symlink to parent", []Entry{{Name: "dir/link", Link: "../../a.txt"}}, "symlink points outside destination"},
+		{"symlink absolute", []Entry{{Name: "link", Link: "/etc"}}, "symlink points outside destination"},
+		{"symlink windows", []Entry{{Name: "link", Link: "C:\\Windows"}}, "symlink points outside destination"},
+		{"symlink chain", []Entry{
+			{Name: "dir/up", Link: ".."},
+			{Name: "link", Link: "dir/up/.."},
+		}, "symlink points outside destination"},
+		{"symlink loop", []Entry{
+			{Name: "a", Link: "b"},
+			{Name: "b", Link: "a"},
+		}, "symlink points outside destination"},
+		{"written through symlink", []Entry{
+			{Name: "x", Link: "/etc"},
+			{Name: "x/passwd"},
+		}, "symlink points outside destination"},
+		{"written through symlink first", []Entry{
+			{Name: "x/passwd"},
+			{Name: "x", Link: "/etc"},
+		}, "entry is written through a symlink pointing outside destination"},
+		{"written through relative symlink", []Entry{
+			{Name: "dir/x/passwd"},
+			{Name: "dir/x", Link: "../.."},
+		}, "entry is written through a symlink pointing outside destination"},
+		{"written through inner symlink", []Entry{
+			{Name: "x", Link: "dir"},
+			{Name: "x/a.txt"},
+		}, ""},
+		{"hardlink", []Entry{{Name: "a.txt"}, {Name: "b.txt", Link: "a.txt", Hard: true}}, ""},
+		{"hardlink absolute", []Entry{{Name: "b.txt", Link: "/etc/passwd", Hard: true}}, "hardlink to file outside destination"},
+		{"hardlink to parent", []Entry{{Name: "dir/b.txt", Link: "../a.txt", Hard: true}}, "hardlink to file outside destination"},
+		{"hardlink through symlink", []Entry{
+			{Name: "x", Link: "/etc"},
+			{Name: "b.txt", Link: "x/passwd", Hard: true},
+		}, "symlink points outside destination"},
+	}
+
+	for _, test := range tests {
+		err := checkEntries(test.entries)
+		var se *SecurityError
+		switch {
+		case len(test.reason) == 0 && err != nil:
+			t.Errorf("%s: checkEntries = %v, want nil", test.name, err)
+		case len(test.reason) > 0 && !errors.As(err, &se):
+			t.Errorf("%s: checkEntries = %v, want %q", test.name, err, test.reason)
+		case len(test.reason) > 0 && se.Reason != test.reason:
+			t.Errorf("%s: checkEntries = %q, want %q", test.name, se.Reason, test.reason)
+		}
+	}
+}
+
+func TestMergeTree(t *testing.T) {
+	dir := t.TempDir()
+	src, dest := filepath.Join(dir, "src"), filepath.Join(dir, "dest")
+	for path, data := range map[string]string{
+		"src/a.txt":      "new",
+		"src/dir/b.txt":  "new",
+		"src/file/c.txt": "new",
+		"dest/a.txt":     "old",
+		"dest/dir/d.txt": "old",
+		"dest/file":      "old",
+	} {
+		path = filepath.Join(dir, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := mergeTree(src, dest); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{
+		"a.txt":      "new",
+		"dir/b.txt":  "new",
+		"dir/d.txt":  "old",
+		"file/c.txt": "new",
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(dest, filepath.FromSlash(path)))
+		if err != nil || string(data) != want {
+			t.Errorf("%s = %q, %v, want %q", path, data, err, want)
+		}
+	}
+
+	// A directory isn't replaced by a file
+	src = filepath.Join(dir, "src2")
+	os.Mkdir(src, 0755)
+	if err := ioutil.WriteFile(filepath.Join(src, "dir"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := mergeTree(src, dest); err == nil {
+		t.Error("mergeTree replaced a directory with a file")
+	}
+}
@@ -0,0 +1,175 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestVerifyTree(t *testing.T) {
+	write := func(path string) error {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(path, []byte("data"), 0644)
+	}
+
+	tests := []struct {
+		name    string
+		before  func(dest, outside string) error
+		extract func(dest, outside string) error
+		reason  string
+		paths   string
+		kept    []string
+		removed []string
+	}{
+		{
+			name: "files",
+			extract: func(dest, outside string) error {
+				return write(filepath.Join(dest, "dir", "a.txt"))
+			},
+			paths: "dir,dir/a.txt",
+			kept:  []string{"dir/a.txt"},
+		},
+		{
+			name: "symlink inside",
+			extract: func(dest, outside string) error {
+				if err := write(filepath.Join(dest, "a.txt")); err != nil {
+					return err
+				}
+				return os.Symlink("a.txt", filepath.Join(dest, "link"))
+			},
+			paths: "a.txt,link",
+			kept:  []string{"a.txt", "link"},
+		},
+		{
+			name: "symlink outside",
+			extract: func(dest, outside string) error {
+				return os.Symlink("../outside/secret", filepath.Join(dest, "link"))
+			},
+			reason:  "symlink points outside destination",
+			removed: []string{"link"},
+		},
+		{
+			name: "symlink absolute",
+			extract: func(dest, outside string) error {
+				return os.Symlink(outside, filepath.Join(dest, "link"))
+			},
+			reason:  "symlink points outside destination",
+			removed: []string{"link"},
+		},
+		{
+			name: "symlink through old symlink",
+			before: func(dest, outside string) error {
+				return os.Symlink(outside, filepath.Join(dest, "old"))
+			},
+			extract: func(dest, outside string) error {
+				return os.Symlink("old/secret", filepath.Join(dest, "link"))
+			},
+			reason:  "symlink resolves outside destination",
+			kept:    []string{"old"},
+			removed: []string{"link"},
+		},
+		{
+			name: "hardlink inside",
+			extract: func(dest, outside string) error {
+				if err := write(filepath.Join(dest, "a.txt")); err != nil {
+					return err
+				}
+				return os.Link(filepath.Join(dest, "a.txt"), filepath.Join(dest, "b.txt"))
+			},
+			paths: "a.txt,b.txt",
+			kept:  []string{"a.txt", "b.txt"},
+		},
+		{
+			name: "hardlink outside",
+			extract: func(dest, outside string) error {
+				return os.Link(filepath.Join(outside, "secret"), filepath.Join(dest, "a.txt"))
+			},
+			reason:  "hardlink to file outside destination",
+			removed: []string{"a.txt"},
+		},
+		{
+			name: "special file",
+			extract: func(dest, outside string) error {
+				return syscall.Mkfifo(filepath.Join(dest, "fifo"), 0644)
+			},
+			reason:  "special file",
+			removed: []string{"fifo"},
+		},
+		{
+			name: "old files kept",
+			before: func(dest, outside string) error {
+				if err := write(filepath.Join(dest, "old.txt")); err != nil {
+					return err
+				}
+				if err := os.Link(filepath.Join(outside, "secret"), filepath.Join(dest, "hard")); err != nil {
+					return err
+				}
+				return os.Symlink(outside, filepath.Join(dest, "link"))
+			},
+			extract: func(dest, outside string) error {
+				return write(filepath.Join(dest, "new.txt"))
+			},
+			paths: "new.txt",
+			kept:  []string{"old.txt", "hard", "link", "new.txt"},
+		},
+	}
+
+	for _, test := range tests {
+		dir := t.TempDir()
+		dest, outside := filepath.Join(dir, "dest"), filepath.Join(dir, "outside")
+		if err := write(filepath.Join(outside, "secret")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Mkdir(dest, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if test.before != nil {
+			if err := test.before(dest, outside); err != nil {
+				t.Fatal(err)
+			}
+		}
+		snap, err := snapshotTree(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := test.extract(dest, outside); err != nil {
+			t.Fatal(err)
+		}
+
+		ex, err := verifyTree(dest, snap)
+		var se *SecurityError
+		switch {
+		case len(test.reason) == 0 && err != nil:
+			t.Errorf("%s: verifyTree = %v, want nil", test.name, err)
+		case len(test.reason) > 0 && !errors.As(err, &se):
+			t.Errorf("%s: verifyTree = %v, want %q", test.name, err, test.reason)
+		case len(test.reason) > 0 && se.Reason != test.reason:
+			t.Errorf("%s: verifyTree = %q, want %q", test.name, se.Reason, test.reason)
+		}
+
+		if paths := filepath.ToSlash(strings.Join(ex.paths, ",")); paths != test.paths {
+			t.Errorf("%s: extracted %q, want %q", test.name, paths, test.paths)
+		}
+		for _, path := range test.kept {
+			if _, err := os.Lstat(filepath.Join(dest, path)); err != nil {
+				t.Errorf("%s: %s was removed", test.name, path)
+			}
+		}
+		for _, path := range test.removed {
+			if _, err := os.Lstat(filepath.Join(dest, path)); err == nil {
+				t.Errorf("%s: %s was kept", test.name, path)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(outside, "secret")); err != nil {
+			t.Errorf("%s: the file outside was removed", test.name)
+		}
+	}
+}
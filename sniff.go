@@ -0,0 +1,162 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Signature identifies an archive type by its content
+type Signature int
+
+const (
+	// SigNone means the file has no known signature
+	SigNone Signature = iota
+	SigRAR4
+	SigRAR5
+	SigZIP
+	Sig7z
+	SigGzip
+	SigXz
+)
+
+var signatures = []struct {
+	sig   Signature
+	magic []byte
+}{
+	{SigRAR5, []byte("Rar!\x1a\x07\x01\x00")},
+	{SigRAR4, []byte("Rar!\x1a\x07\x00")},
+	{SigZIP, []byte("PK\x03\x04")},
+	{SigZIP, []byte("PK\x05\x06")},
+	{SigZIP, []byte("PK\x07\x08")},
+	{Sig7z, []byte("7z\xbc\xaf\x27\x1c")},
+	{SigXz, []byte("\xfd7zXZ\x00")},
+	{SigGzip, []byte("\x1f\x8b")},
+}
+
+// Self extracting archives have the archive appended to an executable
+const sfxSearchSize = 1 << 20
+
+var sigNames = map[Signature]string{
+	SigNone: "none",
+	SigRAR4: "rar4",
+	SigRAR5: "rar5",
+	SigZIP:  "zip",
+	Sig7z:   "7z",
+	SigGzip: "gzip",
+	SigXz:   "xz",
+}
+
+func (s Signature) String() string {
+	return sigNames[s]
+}
+
+// IsRAR returns true for both RAR signature versions
+func (s Signature) IsRAR() bool {
+	return s == SigRAR4 || s == SigRAR5
+}
+
+// sniff reads the start of a file and returns its signature. Windows
+// executables are checked for an embedded RAR or ZIP archive.
+func sniff(path string) Signature {
+	f, err := os.Open(path)
+	if err != nil {
+		return SigNone
+	}
+	defer f.Close()
+
+	size := 8
+	sfx := strings.EqualFold(filepath.Ext(path), ".exe")
+	if sfx {
+		size = sfxSearchSize
+	}
+
+	head := make([]byte, size)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return SigNone
+	}
+	head = head[:n]
+
+	for _, s := range signatures {
+		if bytes.HasPrefix(head, s.magic) {
+			return s.sig
+		}
+	}
+
+	if sfx {
+		return sniffSFX(f, head)
+	}
+
+	return SigNone
+}
+
+// sniffSFX looks for an archive appended to an executable. Executables
+// may contain the signatures for other reasons, so a zip needs its end of
+// central directory record at the end of the file and a rar signature has
+// to be followed by a valid main archive header.
+func sniffSFX(f *os.File, head []byte) Signature {
+	if info, err := f.Stat(); err == nil {
+		if _, err := zip.NewReader(f, info.Size()); err == nil {
+			return SigZIP
+		}
+	}
+
+	for _, s := range signatures {
+		if !s.sig.IsRAR() {
+			continue
+		}
+		for off := 0; ; off++ {
+			i := bytes.Index(head[off:], s.magic)
+			if i < 0 {
+				break
+			}
+			off += i
+			if rarHeaderAt(head, s.sig, off+len(s.magic)) {
+				return s.sig
+			}
+		}
+	}
+
+	return SigNone
+}
+
+// rarHeaderAt returns true if buf holds a main archive header with a
+// valid checksum at off, the header that follows the signature
+func rarHeaderAt(buf []byte, sig Signature, off int) bool {
+	if sig == SigRAR4 {
+		// CRC16, type 0x73, flags and the size of the header
+		if off+7 > len(buf) || buf[off+2] != 0x73 {
+			return false
+		}
+		size := int(binary.LittleEndian.Uint16(buf[off+5:]))
+		if size < 7 || off+size > len(buf) {
+			return false
+		}
+		sum := crc32.ChecksumIEEE(buf[off+2 : off+size])
+		return uint16(sum) == binary.LittleEndian.Uint16(buf[off:])
+	}
+
+	// CRC32, and a header size and type stored as variable length
+	// integers, the type of the main archive header is 1
+	if off+4 > len(buf) {
+		return false
+	}
+	size, n := binary.Uvarint(buf[off+4:])
+	if n <= 0 || size == 0 || size > uint64(len(buf)) {
+		return false
+	}
+	end := off + 4 + n + int(size)
+	if end > len(buf) {
+		return false
+	}
+	if kind, m := binary.Uvarint(buf[off+4+n : end]); m <= 0 || kind != 1 {
+		return false
+	}
+	return crc32.ChecksumIEEE(buf[off+4:end]) == binary.LittleEndian.Uint32(buf[off:])
+}
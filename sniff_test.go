@@ -0,0 +1,78 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+var (
+	// empty archives as written by rar
+	testRAR4 = []byte("Rar!\x1a\x07\x00\xcf\x90\x73\x00\x00\x0d\x00\x00\x00\x00\x00\x00\x00")
+	testRAR5 = []byte("Rar!\x1a\x07\x01\x00\x33\x92\xb5\xe5\x0a\x01\x05\x06\x00\x05\x01\x01\x80\x80\x00")
+	testStub = bytes.Repeat([]byte("MZ\x90\x00"), 1024)
+)
+
+func testZIP(t *testing.T) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	f, err := w.Create("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("content"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestSniff(t *testing.T) {
+	zipped := testZIP(t)
+	tests := []struct {
+		name string
+		data []byte
+		want Signature
+	}{
+		{"a.rar", testRAR4, SigRAR4},
+		{"a.rar", testRAR5, SigRAR5},
+		{"a.cbz", zipped, SigZIP},
+		{"a.7z", []byte("7z\xbc\xaf\x27\x1c\x00\x04"), Sig7z},
+		{"a.gz", []byte("\x1f\x8b\x08\x00"), SigGzip},
+		{"a.xz", []byte("\xfd7zXZ\x00\x00\x04"), SigXz},
+		{"a.txt", []byte("plain text"), SigNone},
+		{"empty", nil, SigNone},
+
+		{"sfx.exe", join(testStub, zipped), SigZIP},
+		{"sfx.exe", join(testStub, testRAR4, testStub), SigRAR4},
+		{"sfx.exe", join(testStub, testRAR5, testStub), SigRAR5},
+		{"SFX.EXE", join(testStub, testRAR5), SigRAR5},
+		{"sfx.bin", join(testStub, testRAR5), SigNone},
+
+		// signatures that are not followed by an archive
+		{"setup.exe", join(testStub, []byte("PK\x03\x04"), testStub), SigNone},
+		{"setup.exe", join(testStub, zipped[:len(zipped)-22], testStub), SigNone},
+		{"setup.exe", join(testStub, []byte("Rar!\x1a\x07\x00"), testStub), SigNone},
+		{"setup.exe", join(testStub, testRAR4[:12], []byte{0xff}, testRAR4[13:]), SigNone},
+		{"setup.exe", join(testStub, []byte("Rar!\x1a\x07\x01\x00"), testStub), SigNone},
+		{"setup.exe", join(testStub, testRAR5[:len(testRAR5)-1]), SigNone},
+	}
+
+	dir := t.TempDir()
+	for i, test := range tests {
+		path := filepath.Join(dir, fmt.Sprintf("%d-%s", i, test.name))
+		if err := ioutil.WriteFile(path, test.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := sniff(path); got != test.want {
+			t.Errorf("%d: sniff(%s) = %s, want %s", i, test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Name of the job journal in the state path
+const stateFileName = "jobs.jsonl"
+
+// Name of the file in the state path with the time of the first start
+const installFileName = "installed"
+
+// Job states kept in the state store
+const (
+	jobChecked   = "checked"
+	jobUnpacking = "unpacking"
+	jobUnpacked  = "unpacked"
+	jobFailed    = "failed"
+	jobCanceled  = "canceled"
+	jobRemoved   = "removed"
+)
+
+// jobRecord is what the daemon knows about the jobs of a torrent
+type jobRecord struct {
+	Hash      string    `json:"hash"`
+	Name      string    `json:"name,omitempty"`
+	Status    string    `json:"status"`
+	Category  string    `json:"category,omitempty"`
+	Attempts  uint      `json:"attempts,omitempty"`
+	Retries   uint      `json:"retries,omitempty"`
+	Heals     uint      `json:"heals,omitempty"`
+	RetryAt   time.Time `json:"retry_at"`
+	Error     string    `json:"error,omitempty"`
+	ErrorType string    `json:"error_type,omitempty"`
+	Dest      string    `json:"dest,omitempty"`
+	Checked   time.Time `json:"checked"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+	Updated   time.Time `json:"updated"`
+}
+
+// setResult saves the outcome of a job in the record
+func (rec *jobRecord) setResult(status, category string, err error) {
+	rec.Status = status
+	rec.Category = category
+	rec.Error = ""
+	rec.ErrorType = errorType(err)
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	rec.Finished = time.Now()
+}
+
+// stateStore keeps the job records of all torrents in a JSON-lines journal,
+// every change is appended as the complete record and the last one wins.
+// A nil store keeps nothing.
+type stateStore struct {
+	mutex   sync.Mutex
+	path    string
+	file    *os.File
+	records map[string]*jobRecord
+	missing map[string]int
+}
+
+// openStateStore loads the journal in dir and compacts it to the current
+// record of each torrent. It returns a nil store if dir is empty.
+func openStateStore(dir string) (*stateStore, error) {
+	st, err := loadStateStore(dir)
+	if st == nil || err != nil {
+		return nil, err
+	}
+
+	if err := st.compact(); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// appendStateStore loads the journal in dir and appends to it without
+// rewriting it, so it can be used while the daemon has it open. It
+// returns a nil store if dir is empty.
+func appendStateStore(dir string) (*stateStore, error) {
+	st, err := loadStateStore(dir)
+	if st == nil || err != nil {
+		return nil, err
+	}
+
+	st.file, err = os.OpenFile(st.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// loadStateStore reads the current record of each torrent from the
+// journal in dir
+func loadStateStore(dir string) (*stateStore, error) {
+	if len(dir) == 0 {
+		return nil, nil
+	}
+
+	st := &stateStore{
+		path:    filepath.Join(dir, stateFileName),
+		records: make(map[string]*jobRecord),
+		missing: make(map[string]int),
+	}
+
+	if file, err := os.Open(st.path); err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(nil, 1024*1024)
+		for scanner.Scan() {
+			rec := &jobRecord{}
+			// A line cut short by a crash is skipped
+			if json.Unmarshal(scanner.Bytes(), rec) != nil || len(rec.Hash) == 0 {
+				continue
+			}
+			if rec.Status == jobRemoved {
+				delete(st.records, rec.Hash)
+			} else {
+				st.records[rec.Hash] = rec
+			}
+		}
+		file.Close()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return st, nil
+}
+
+// compact rewrites the journal with only the current records
+func (st *stateStore) compact() error {
+	tmp := st.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+	enc := json.NewEncoder(w)
+	for _, rec := range st.records {
+		if err = enc.Encode(rec); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+
+	if err == nil {
+		err = os.Rename(tmp, st.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	st.file, err = os.OpenFile(st.path, os.O_WRONLY|os.O_APPEND, 0644)
+	return err
+}
+
+// append writes a record to the journal
+func (st *stateStore) append(rec *jobRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err = st.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return st.file.Sync()
+}
+
+// Get returns a copy of the record of a torrent
+func (st *stateStore) Get(hash string) (jobRecord, bool) {
+	if st == nil {
+		return jobRecord{}, false
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if rec, ok := st.records[hash]; ok {
+		return *rec, true
+	}
+	return jobRecord{}, false
+}
+
+// Update changes the record of a torrent with fn and saves it, a new
+// record is created for an unknown torrent
+func (st *stateStore) Update(t *Torrent, fn func(rec *jobRecord)) error {
+	if st == nil {
+		return nil
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	rec, ok := st.records[t.Hash]
+	if !ok {
+		rec = &jobRecord{Hash: t.Hash}
+		st.records[t.Hash] = rec
+	}
+
+	rec.Name = t.Name
+	fn(rec)
+	rec.Updated = time.Now()
+	return st.append(rec)
+}
+
+// Prune forgets the torrents that were missing from the last
+// removedPolls torrent lists of qBittorrent. An empty list is ignored,
+// so a qBittorrent that lost its torrents for a moment doesn't wipe the
+// state. It returns the hashes of the forgotten torrents.
+func (st *stateStore) Prune(torrents []*Torrent) ([]string, error) {
+	if st == nil || len(torrents) == 0 {
+		return nil, nil
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	present := make(map[string]bool, len(torrents))
+	for _, t := range torrents {
+		present[t.Hash] = true
+	}
+
+	var pruned []string
+	for hash := range st.records {
+		if present[hash] {
+			delete(st.missing, hash)
+			continue
+		}
+		if st.missing[hash]++; st.missing[hash] < removedPolls {
+			continue
+		}
+
+		delete(st.records, hash)
+		delete(st.missing, hash)
+		if err := st.append(&jobRecord{Hash: hash, Status: jobRemoved, Updated: time.Now()}); err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, hash)
+	}
+	return pruned, nil
+}
+
+// installTime returns when the daemon first started with the state path
+// in dir, which is kept in a file in it. Without a state path this is
+// the time the daemon started.
+func installTime(dir string) (time.Time, error) {
+	now := time.Now()
+	if len(dir) == 0 {
+		return now, nil
+	}
+
+	path := filepath.Join(dir, installFileName)
+	if data, err := ioutil.ReadFile(path); err == nil {
+		return time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+	} else if !os.IsNotExist(err) {
+		return now, err
+	}
+
+	return now, ioutil.WriteFile(path, []byte(now.Format(time.RFC3339)+"\n"), 0644)
+}
+
+// Close closes the journal
+func (st *stateStore) Close() error {
+	if st == nil {
+		return nil
+	}
+	return st.file.Close()
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Tag of torrents that qbDaemon paused while unpacking them
+const tagPaused = "qbd:paused"
+
+// Name of the file in the state path that marks the alternative speed
+// limits as enabled by qbDaemon
+const altSpeedFileName = "altspeed"
+
+// Throttle ...
+type Throttle struct {
+	hash string
+}
+
+// Unthrottle ...
+type Unthrottle struct {
+	hash string
+}
+
+// throttler keeps what qbDaemon changed in qBittorrent to reduce the disk
+// load while unpacking, so it can be changed back afterwards. Paused
+// torrents are tagged and the alternative speed limits are marked in the
+// state path, so the changes are also undone after a crash.
+type throttler struct {
+	running  map[string]bool
+	paused   map[string]bool
+	altSpeed bool
+	marker   string
+	restored bool
+}
+
+func newThrottler(statePath string) *throttler {
+	th := &throttler{
+		running: make(map[string]bool),
+		paused:  make(map[string]bool),
+	}
+	if len(statePath) > 0 {
+		th.marker = filepath.Join(statePath, altSpeedFileName)
+	}
+	return th
+}
+
+// mark records that the alternative speed limits were enabled by qbDaemon
+func (th *throttler) mark(enabled bool) {
+	th.altSpeed = enabled
+	if len(th.marker) == 0 {
+		return
+	}
+
+	var err error
+	if enabled {
+		err = ioutil.WriteFile(th.marker, []byte(time.Now().Format(time.RFC3339)+"\n"), 0644)
+	} else if err = os.Remove(th.marker); os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		log.Printf("[Manager] Error updating %s; %s", th.marker, err.Error())
+	}
+}
+
+// throttleError logs an error of throttling qBittorrent. Only timeouts are
+// returned, to retry them, as unpacking goes on regardless.
+func throttleError(err error, what string) error {
+	if err == nil || err == context.DeadlineExceeded {
+		return err
+	}
+	log.Printf("[Manager] Could not %s; %s", what, err.Error())
+	return nil
+}
+
+// throttle reduces the disk load of qBittorrent while a torrent is unpacked
+func (d *Dispatcher) throttle(ctx context.Context, tc *QbClient, hash string) error {
+	th := d.limiter
+	th.running[hash] = true
+
+	if d.cfg().Throttle.AltSpeed && !th.altSpeed {
+		enabled, err := tc.SpeedLimitsMode(ctx)
+		if err != nil {
+			return throttleError(err, "get the speed limits mode")
+		}
+		// Limits that were enabled already are left to the user
+		if !enabled {
+			// Marked first, as a toggle that timed out may have been done
+			th.mark(true)
+			if err := tc.ToggleSpeedLimitsMode(ctx); err != nil {
+				if err != context.DeadlineExceeded {
+					th.mark(false)
+				}
+				return throttleError(err, "enable the alternative speed limits")
+			}
+			log.Println("[Manager] Alternative speed limits enabled while unpacking")
+		}
+	}
+
+	if d.cfg().Throttle.Pause && !th.paused[hash] {
+		// Torrents that were paused already are left to the user
+		if t := d.tm.Get(hash); t != nil && !t.IsPaused() {
+			if err := tc.Pause(ctx, hash); err != nil {
+				return throttleError(err, "pause torrent "+hash)
+			}
+			th.paused[hash] = true
+			if err := tc.AddTags(ctx, hash, tagPaused); err != nil {
+				return throttleError(err, "tag torrent "+hash)
+			}
+			log.Printf("[Manager] Torrent %s paused while unpacking\n", hash)
+		}
+	}
+
+	return nil
+}
+
+// unthrottle undoes what throttle changed once a torrent was unpacked,
+// the alternative speed limits once no more torrents are unpacked
+func (d *Dispatcher) unthrottle(ctx context.Context, tc *QbClient, hash string) error {
+	th := d.limiter
+	delete(th.running, hash)
+
+	if th.paused[hash] {
+		if err := d.resumePaused(ctx, tc, hash); err != nil {
+			return err
+		}
+		delete(th.paused, hash)
+	}
+
+	if th.altSpeed && len(th.running) == 0 {
+		if err := d.disableAltSpeed(ctx, tc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resumePaused resumes a torrent paused by throttle and removes its tag
+func (d *Dispatcher) resumePaused(ctx context.Context, tc *QbClient, hash string) error {
+	if err := tc.Resume(ctx, hash); err != nil {
+		return throttleError(err, "resume torrent "+hash)
+	}
+	if err := tc.RemoveTags(ctx, hash, tagPaused); err != nil {
+		return throttleError(err, "untag torrent "+hash)
+	}
+	log.Printf("[Manager] Torrent %s resumed after unpacking\n", hash)
+	return nil
+}
+
+// disableAltSpeed switches the alternative speed limits enabled by
+// throttle off again, unless the user did already
+func (d *Dispatcher) disableAltSpeed(ctx context.Context, tc *QbClient) error {
+	enabled, err := tc.SpeedLimitsMode(ctx)
+	if err != nil {
+		return throttleError(err, "get the speed limits mode")
+	}
+	if enabled {
+		if err := tc.ToggleSpeedLimitsMode(ctx); err != nil {
+			return throttleError(err, "disable the alternative speed limits")
+		}
+		log.Println("[Manager] Alternative speed limits disabled after unpacking")
+	}
+	d.limiter.mark(false)
+	return nil
+}
+
+// restoreThrottle undoes the changes of a run of the daemon that stopped
+// in the middle of unpacking. The unpack jobs that are resumed throttle
+// qBittorrent again once they start.
+func (d *Dispatcher) restoreThrottle(ctx context.Context, tc *QbClient, torrents []*Torrent) {
+	th := d.limiter
+
+	for _, t := range torrents {
+		if t.HasTag(tagPaused) && !th.running[t.Hash] && !th.paused[t.Hash] {
+			if d.resumePaused(ctx, tc, t.Hash) != nil {
+				return
+			}
+		}
+	}
+
+	if len(th.marker) > 0 && !th.altSpeed {
+		if _, err := os.Stat(th.marker); err == nil {
+			if d.disableAltSpeed(ctx, tc) != nil {
+				return
+			}
+		}
+	}
+
+	th.restored = true
+}
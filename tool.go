@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os/exec"
+	"regexp"
+	"syscall"
+	"time"
+)
+
+// Size of the output kept from an extractor for classifying errors
+const toolTailSize = 8192
+
+// Time to wait for the output of a killed extractor to be closed
+const toolWaitDelay = 5 * time.Second
+
+// tailBuffer keeps the last toolTailSize bytes written to it
+type tailBuffer struct {
+	data []byte
+}
+
+func (tb *tailBuffer) Write(p []byte) (int, error) {
+	tb.data = append(tb.data, p...)
+	if over := len(tb.data) - toolTailSize; over > 0 {
+		tb.data = tb.data[over:]
+	}
+	return len(p), nil
+}
+
+// Output of the extractors that identifies the cause of a failure
+var toolMessages = []struct {
+	re  *regexp.Regexp
+	err error
+}{
+	{regexp.MustCompile(`(?i)no space left|disk full`), ErrDiskFull},
+	{regexp.MustCompile(`(?i)(wrong|incorrect|bad) password|password is incorrect`), ErrPassword},
+	{regexp.MustCompile(`(?i)cannot find volume|missing volume`), ErrMissingVolume},
+	{regexp.MustCompile(`(?i)unsupported|unknown method|not supported`), ErrUnsupported},
+	{regexp.MustCompile(`(?i)permission denied|access denied|operation not permitted`), ErrPermission},
+	{regexp.MustCompile(`(?i)crc failed|bad crc|crc error|checksum error|corrupt`), ErrCRC},
+}
+
+// runTool runs an extractor that writes its output to w at the priority.
+// It returns the exit status and the tail of the output. The error is
+// only set if the tool could not be run or was canceled.
+func runTool(ctx context.Context, tool *exec.Cmd, prio *priority, w io.Writer) (int, []byte, error) {
+	tail := &tailBuffer{}
+	tool.Stdout = io.MultiWriter(w, tail)
+	tool.Stderr = tool.Stdout
+
+	setProcessGroup(tool)
+	tool.WaitDelay = toolWaitDelay
+
+	if err := prio.Start(tool); err != nil {
+		return -1, nil, err
+	}
+
+	if err := tool.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return -1, tail.data, ctx.Err()
+		}
+		if exit, ok := err.(*exec.ExitError); ok {
+			return exit.Sys().(syscall.WaitStatus).ExitStatus(), tail.data, nil
+		}
+		return -1, tail.data, err
+	}
+
+	return 0, tail.data, nil
+}
+
+// toolOutput runs a tool that lists an archive and returns what it printed.
+// A tool that was killed because ctx was canceled returns the error of ctx.
+func toolOutput(ctx context.Context, tool *exec.Cmd) ([]byte, error) {
+	setProcessGroup(tool)
+	tool.WaitDelay = toolWaitDelay
+
+	out, err := tool.Output()
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return out, err
+}
+
+// classify maps a failed exit status to a typed *ExitError, first using
+// the exit codes of the tool and then its output. Unknown failures are
+// returned as ErrUnpackFailed.
+func classify(status int, output []byte, codes map[int]error) error {
+	if err, ok := codes[status]; ok {
+		return &ExitError{Status: status, Err: err}
+	}
+
+	for _, m := range toolMessages {
+		if m.re.Match(output) {
+			return &ExitError{Status: status, Err: m.err}
+		}
+	}
+
+	return &ExitError{Status: status, Err: ErrUnpackFailed}
+}
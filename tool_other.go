@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// setProcessGroup leaves the tool as is where there are no process
+// groups, only the tool itself is killed when the context is canceled
+func setProcessGroup(tool *exec.Cmd) {}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		status int
+		output string
+		want   string
+	}{
+		{3, "", "crc"},
+		{11, "", "password"},
+		{3, "No space left on device", "crc"},
+		{2, "write error: No space left on device", "disk_full"},
+		{2, "The specified password is incorrect.", "password"},
+		{2, "Cannot find volume b.part2.rar", "missing_volume"},
+		{2, "unsupported compression method 99", "unsupported"},
+		{2, "cannot create a.txt: Permission denied", "permission"},
+		{2, "a.txt - checksum error", "crc"},
+		{2, "The archive is corrupt", "crc"},
+		{2, "something went wrong", "error"},
+		{1, "", "error"},
+	}
+
+	for _, test := range tests {
+		err := classify(test.status, []byte(test.output), rarErrors)
+		var exit *ExitError
+		if !errors.As(err, &exit) || exit.Status != test.status {
+			t.Errorf("classify(%d, %q) = %v, want an exit error", test.status, test.output, err)
+		}
+		if got := errorType(err); got != test.want {
+			t.Errorf("classify(%d, %q) is %s, want %s", test.status, test.output, got, test.want)
+		}
+	}
+}
+
+func TestErrorType(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{nil, ""},
+		{&SecurityError{Path: "../a", Reason: "parent directory reference"}, "security"},
+		{ErrMissingVolume, "missing_volume"},
+		{fmt.Errorf("unpacking a.rar: %w", ErrDiskFull), "disk_full"},
+		{syscall.ENOSPC, "disk_full"},
+		{ErrTimeout, "timeout"},
+		{context.Canceled, "error"},
+		{errors.New("something went wrong"), "error"},
+	}
+
+	for _, test := range tests {
+		if got := errorType(test.err); got != test.want {
+			t.Errorf("errorType(%v) = %s, want %s", test.err, got, test.want)
+		}
+	}
+}
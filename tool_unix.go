@@ -0,0 +1,20 @@
+//go:build unix
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup runs the tool in its own process group, so that any
+// processes it started are killed with it when the context is canceled
+func setProcessGroup(tool *exec.Cmd) {
+	if tool.SysProcAttr == nil {
+		tool.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	tool.SysProcAttr.Setpgid = true
+	tool.Cancel = func() error {
+		return syscall.Kill(-tool.Process.Pid, syscall.SIGKILL)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// cmdCustom is an extractor defined in the 'formats' section of the config
+type cmdCustom struct {
+	name     string
+	command  string
+	ext      *regexp.Regexp
+	magic    []byte
+	first    *regexp.Regexp
+	args     []string
+	list     []string
+	test     []string
+	password string
+	success  []int
+	sandbox  *sandbox
+	priority *priority
+}
+
+// newCustomFormat validates a format from the config and creates it
+func newCustomFormat(f *format, sb *sandbox, prio *priority) (*cmdCustom, error) {
+	cmd := &cmdCustom{
+		name:     f.Name,
+		command:  f.Command,
+		args:     f.Args,
+		list:     f.List,
+		test:     f.Test,
+		password: f.Password,
+		success:  f.Success,
+		sandbox:  sb,
+		priority: prio,
+	}
+
+	if len(cmd.name) == 0 {
+		return nil, fmt.Errorf("format is missing a 'name'")
+	}
+
+	if len(cmd.command) == 0 {
+		return nil, fmt.Errorf("format %s is missing a 'command'", cmd.name)
+	}
+
+	if len(f.Ext) == 0 && len(f.Magic) == 0 {
+		return nil, fmt.Errorf("format %s needs 'ext' or 'magic'", cmd.name)
+	}
+
+	// Entries are checked before they are extracted
+	if len(cmd.list) == 0 {
+		return nil, fmt.Errorf("format %s is missing a 'list'", cmd.name)
+	}
+
+	hasSrc := false
+	for _, arg := range cmd.args {
+		if strings.Contains(arg, "{src}") {
+			hasSrc = true
+		}
+	}
+	if !hasSrc {
+		return nil, fmt.Errorf("format %s 'args' must contain {src}", cmd.name)
+	}
+
+	var err error
+	if len(f.Ext) > 0 {
+		if cmd.ext, err = regexp.Compile(f.Ext); err != nil {
+			return nil, fmt.Errorf("format %s 'ext'; %s", cmd.name, err.Error())
+		}
+	}
+
+	if len(f.Magic) > 0 {
+		if cmd.magic, err = hex.DecodeString(f.Magic); err != nil {
+			return nil, fmt.Errorf("format %s 'magic'; %s", cmd.name, err.Error())
+		}
+	}
+
+	if len(f.FirstVolume) > 0 {
+		if cmd.first, err = regexp.Compile(f.FirstVolume); err != nil {
+			return nil, fmt.Errorf("format %s 'first_volume'; %s", cmd.name, err.Error())
+		}
+	}
+
+	if len(cmd.success) == 0 {
+		cmd.success = []int{0}
+	}
+
+	return cmd, nil
+}
+
+func (cmd *cmdCustom) Name() string {
+	return cmd.name
+}
+
+// expand replaces the placeholders in an argument template
+func (cmd *cmdCustom) expand(template []string, src, dest string) []string {
+	r := strings.NewReplacer("{src}", src, "{dest}", dest, "{password}", cmd.password)
+	args := make([]string, len(template))
+	for i, arg := range template {
+		args[i] = r.Replace(arg)
+	}
+	return args
+}
+
+// run runs the tool, exit codes not listed in 'success' are
+// classified by the output of the tool or returned as failed
+func (cmd *cmdCustom) run(ctx context.Context, tool *exec.Cmd, w io.Writer, failed error) error {
+	status, out, err := runTool(ctx, tool, cmd.priority, w)
+	if err != nil {
+		return err
+	}
+
+	for _, code := range cmd.success {
+		if code == status {
+			return nil
+		}
+	}
+
+	if failed == ErrTestFailed {
+		return failed
+	}
+	return classify(status, out, nil)
+}
+
+func (cmd *cmdCustom) Unpack(ctx context.Context, src, dest string, w io.Writer) error {
+
+	tool := cmd.sandbox.Command(ctx, src, dest, cmd.command, cmd.expand(cmd.args, src, dest)...)
+	return cmd.run(ctx, tool, w, ErrUnpackFailed)
+}
+
+// Test runs the 'test' template, formats without one can't be tested
+func (cmd *cmdCustom) Test(ctx context.Context, src string, w io.Writer) error {
+	if len(cmd.test) == 0 {
+		return ErrTestUnsupported
+	}
+
+	tool := cmd.sandbox.Command(ctx, src, "", cmd.command, cmd.expand(cmd.test, src, "")...)
+	return cmd.run(ctx, tool, w, ErrTestFailed)
+}
+
+// List returns the entries of the archive, one per line. A line in the
+// form 'name -> target' is a symlink.
+func (cmd *cmdCustom) List(ctx context.Context, src string) ([]Entry, error) {
+	out, err := toolOutput(ctx, cmd.sandbox.Command(ctx, src, "", cmd.command, cmd.expand(cmd.list, src, "")...))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	for _, line := range splitLines(out) {
+		name, link, _ := strings.Cut(line, " -> ")
+		entries = append(entries, Entry{Name: name, Link: link})
+	}
+	return entries, nil
+}
+
+// hasMagic returns true if the file starts with the magic bytes
+func (cmd *cmdCustom) hasMagic(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	head := make([]byte, len(cmd.magic))
+	if _, err := io.ReadFull(f, head); err != nil {
+		return false
+	}
+	return bytes.Equal(head, cmd.magic)
+}
+
+// CheckPath matches the file name against 'ext' or the file content
+// against 'magic'. Without a 'first_volume' rule every file is a target.
+func (cmd *cmdCustom) CheckPath(path string, sig Signature) Match {
+	name := filepath.Base(path)
+
+	if (cmd.ext == nil || !cmd.ext.MatchString(name)) &&
+		(cmd.magic == nil || !cmd.hasMagic(path)) {
+		return MatchNone
+	}
+
+	if cmd.first != nil && !cmd.first.MatchString(name) {
+		return MatchVolume
+	}
+
+	return MatchFirst
+}
+
+func (cmd *cmdCustom) Installed() bool {
+	_, err := exec.LookPath(cmd.command)
+	return err == nil
+}
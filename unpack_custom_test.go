@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNewCustomFormat(t *testing.T) {
+	valid := func() format {
+		return format{
+			Name:    "7z",
+			Ext:     `\.7z$`,
+			Command: "7z",
+			Args:    []string{"x", "-o{dest}", "{src}"},
+			List:    []string{"l", "-slt", "{src}"},
+		}
+	}
+
+	tests := []struct {
+		change func(f *format)
+		err    string
+	}{
+		{func(f *format) {}, ""},
+		{func(f *format) { f.Ext, f.Magic = "", "377abcaf271c" }, ""},
+		{func(f *format) { f.Name = "" }, "missing a 'name'"},
+		{func(f *format) { f.Command = "" }, "missing a 'command'"},
+		{func(f *format) { f.Ext = "" }, "needs 'ext' or 'magic'"},
+		{func(f *format) { f.List = nil }, "missing a 'list'"},
+		{func(f *format) { f.Args = []string{"x", "{dest}"} }, "must contain {src}"},
+		{func(f *format) { f.Ext = `\.(7z$` }, "'ext'"},
+		{func(f *format) { f.Magic = "37z" }, "'magic'"},
+		{func(f *format) { f.FirstVolume = `(` }, "'first_volume'"},
+	}
+
+	for i, test := range tests {
+		f := valid()
+		test.change(&f)
+		cmd, err := newCustomFormat(&f, nil, nil)
+		switch {
+		case len(test.err) == 0 && err != nil:
+			t.Errorf("%d: newCustomFormat = %v, want nil", i, err)
+		case len(test.err) == 0 && !reflect.DeepEqual(cmd.success, []int{0}):
+			t.Errorf("%d: success = %v, want [0]", i, cmd.success)
+		case len(test.err) > 0 && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%d: newCustomFormat = %v, want an error with %q", i, err, test.err)
+		}
+	}
+}
+
+func TestCustomExpand(t *testing.T) {
+	cmd := &cmdCustom{password: "secret"}
+	got := cmd.expand([]string{"x", "-p{password}", "-o{dest}", "{src}", "{other}"}, "/dl/a.7z", "/out")
+	want := []string{"x", "-psecret", "-o/out", "/dl/a.7z", "{other}"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expand = %q, want %q", got, want)
+	}
+}
+
+func TestScanPath(t *testing.T) {
+	cmd, err := newCustomFormat(&format{
+		Name:        "7z",
+		Ext:         `\.7z(\.\d{3})?$`,
+		Magic:       "377abcaf271c",
+		FirstVolume: `(\.7z|\.001)$`,
+		Command:     "7z",
+		Args:        []string{"x", "{src}"},
+		List:        []string{"l", "{src}"},
+	}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"a/x.7z.001":    []byte("7z\xbc\xaf\x27\x1c"),
+		"a/x.7z.002":    []byte("data"),
+		"a/xy.7z.001":   []byte("7z\xbc\xaf\x27\x1c"),
+		"a/xy.7z.002":   []byte("data"),
+		"a/b.part1.rar": testRAR5,
+		"a/b.part2.rar": testRAR5,
+		"b/x.7z.003":    []byte("data"),
+		"b/readme.txt":  []byte("data"),
+		"b/c.rar":       testRAR4,
+	}
+	for name, data := range files {
+		if err := mkdirFile(filepath.Join(dir, filepath.FromSlash(name)), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	u := &Unpacker{Formats: getFormats(nil, nil, []*cmdCustom{cmd})}
+	targets, err := u.ScanPath(context.Background(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]string)
+	for _, target := range targets {
+		var volumes []string
+		for _, v := range target.Volumes() {
+			rel, _ := filepath.Rel(dir, v)
+			volumes = append(volumes, filepath.ToSlash(rel))
+		}
+		got[volumes[0]] = target.format.Name() + " " + strings.Join(volumes[1:], ",")
+	}
+	want := map[string]string{
+		"a/x.7z.001":    "7z a/x.7z.002",
+		"a/xy.7z.001":   "7z a/xy.7z.002",
+		"a/b.part1.rar": "rar a/b.part2.rar",
+		"b/c.rar":       "rar ",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ScanPath = %q, want %q", got, want)
+	}
+}
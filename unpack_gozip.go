@@ -0,0 +1,195 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// goZIP is the built-in zip unpacker, used when unzip is not installed
+type goZIP struct {
+	name     string
+	ext      *regexp.Regexp
+	priority *priority
+}
+
+func (cmd *goZIP) Name() string {
+	return cmd.name
+}
+
+// zipError maps errors of archive/zip to the typed unpack errors
+func zipError(err error) error {
+	switch err {
+	case zip.ErrChecksum, zip.ErrFormat, io.ErrUnexpectedEOF:
+		return ErrCRC
+	case zip.ErrAlgorithm:
+		return ErrUnsupported
+	}
+	return err
+}
+
+func (cmd *goZIP) Unpack(ctx context.Context, src, dest string, w io.Writer) error {
+
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return zipError(err)
+	}
+	defer r.Close()
+
+	limit := cmd.priority.Limit(ctx)
+
+	fmt.Fprintf(w, "Archive:  %s\n", src)
+	for _, f := range r.File {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := checkEntryName(f.Name); err != nil {
+			return err
+		}
+
+		path := filepath.Join(dest, f.Name)
+		mode := f.Mode()
+
+		switch {
+		case mode.IsDir():
+			fmt.Fprintf(w, "   creating: %s\n", path)
+			if err := os.MkdirAll(path, os.ModePerm); err != nil {
+				return err
+			}
+
+		case mode.IsRegular():
+			fmt.Fprintf(w, "  inflating: %s\n", path)
+			if err := cmd.extract(f, path, limit); err != nil {
+				fmt.Fprintf(w, "%s\n", err.Error())
+				return zipError(err)
+			}
+
+		default:
+			// Links and special files are never created
+			fmt.Fprintf(w, "   skipping: %s (%s)\n", path, mode.Type())
+		}
+	}
+
+	return nil
+}
+
+func (cmd *goZIP) extract(f *zip.File, path string, limit *rateLimit) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(limit.Writer(out), rc)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Test reads every file in the archive, which verifies its checksum
+func (cmd *goZIP) Test(ctx context.Context, src string, w io.Writer) error {
+
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	fmt.Fprintf(w, "Archive:  %s\n", src)
+	for _, f := range r.File {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if !f.Mode().IsRegular() {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err == nil {
+			_, err = io.Copy(ioutil.Discard, rc)
+			rc.Close()
+		}
+
+		if err != nil {
+			fmt.Fprintf(w, "    testing: %s   %s\n", f.Name, err.Error())
+			return ErrTestFailed
+		}
+		fmt.Fprintf(w, "    testing: %s   OK\n", f.Name)
+	}
+
+	return nil
+}
+
+// List returns the entries of the archive
+func (cmd *goZIP) List(ctx context.Context, src string) ([]Entry, error) {
+	return zipEntries(src)
+}
+
+// zipEntries reads the entries of a zip archive from its central
+// directory, the targets of symlinks are stored as their content
+func zipEntries(src string) ([]Entry, error) {
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return nil, zipError(err)
+	}
+	defer r.Close()
+
+	var entries []Entry
+	for _, f := range r.File {
+		entry := Entry{Name: f.Name}
+		if f.Mode()&os.ModeSymlink != 0 {
+			if entry.Link, err = zipLink(f); err != nil {
+				return nil, zipError(err)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Longest symlink target read from an archive
+const maxZipLink = 4096
+
+func zipLink(f *zip.File) (string, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	target, err := ioutil.ReadAll(io.LimitReader(rc, maxZipLink+1))
+	if err == nil && len(target) > maxZipLink {
+		err = zip.ErrFormat
+	}
+	return string(target), err
+}
+
+// CheckPath matches zip files by signature, and by extension
+// when the file has no other signature
+func (cmd *goZIP) CheckPath(path string, sig Signature) Match {
+	if sig == SigZIP || (sig == SigNone && cmd.ext.MatchString(filepath.Ext(path))) {
+		return MatchFirst
+	}
+	return MatchNone
+}
+
+func (cmd *goZIP) Installed() bool {
+	return true
+}
@@ -6,46 +6,128 @@ import (
 	"os/exec"
 	"path/filepath"
 	"regexp"
-	"syscall"
+	"strconv"
+	"strings"
 )
 
+var rarPart = regexp.MustCompile(`\.part(\d+)\.rar$`)
+
 type cmdRAR struct {
-	name    string
-	command string
-	ext     *regexp.Regexp
+	name     string
+	command  string
+	ext      *regexp.Regexp
+	sandbox  *sandbox
+	priority *priority
 }
 
 func (cmd *cmdRAR) Name() string {
 	return cmd.name
 }
 
+// Exit codes of unrar
+var rarErrors = map[int]error{
+	3:  ErrCRC,
+	11: ErrPassword,
+}
+
 // Unpack starts the unpacking process.
 func (cmd *cmdRAR) Unpack(ctx context.Context, src, dest string, w io.Writer) error {
 
-	tool := exec.CommandContext(ctx, cmd.command,
+	tool := cmd.sandbox.Command(ctx, src, dest, cmd.command,
 		"x", "-ai", "-c-", "-kb", "-o+", "-p-", "-y", "-v", src, dest)
 
-	tool.Stdout = w
-	tool.Stderr = w
+	status, out, err := runTool(ctx, tool, cmd.priority, w)
+	if err != nil {
+		return err
+	}
+
+	// 10 means there were no files to extract
+	if status != 0 && status != 10 {
+		return classify(status, out, rarErrors)
+	}
+
+	return nil
+}
+
+// Test verifies the checksums of all files in the archive
+func (cmd *cmdRAR) Test(ctx context.Context, src string, w io.Writer) error {
+
+	tool := cmd.sandbox.Command(ctx, src, "", cmd.command, "t", "-p-", "-y", src)
 
-	if err := tool.Start(); err != nil {
+	status, _, err := runTool(ctx, tool, cmd.priority, w)
+	if err != nil {
 		return err
 	}
 
-	if err := tool.Wait(); err != nil {
-		if exit, ok := err.(*exec.ExitError); ok {
-			if exit.Sys().(syscall.WaitStatus).ExitStatus() != 10 {
-				return ErrUnpackFailed
-			}
-		}
+	if status != 0 {
+		return ErrTestFailed
 	}
 
 	return nil
 }
 
-func (cmd *cmdRAR) CheckPath(path string) (string, bool) {
-	directory := filepath.Dir(path) + string(filepath.Separator) + "."
-	return directory, cmd.ext.MatchString(filepath.Ext(path))
+// List returns the entries of the archive from the technical listing,
+// which also holds the targets of links
+func (cmd *cmdRAR) List(ctx context.Context, src string) ([]Entry, error) {
+	out, err := toolOutput(ctx, cmd.sandbox.Command(ctx, src, "", cmd.command, "lt", "-p-", src))
+	if err != nil {
+		return nil, err
+	}
+	return parseRARListing(out), nil
+}
+
+// parseRARListing reads the 'Name', 'Type' and 'Target' fields of each
+// entry in the output of 'unrar lt'
+func parseRARListing(out []byte) []Entry {
+	var entries []Entry
+	var entry *Entry
+	for _, line := range splitLines(out) {
+		key, value, ok := strings.Cut(strings.TrimLeft(line, " "), ": ")
+		if !ok {
+			continue
+		}
+
+		switch {
+		case key == "Name":
+			entries = append(entries, Entry{Name: value})
+			entry = &entries[len(entries)-1]
+		case entry == nil:
+		case key == "Type":
+			entry.Hard = value == "Hard link" || value == "File reference"
+		case key == "Target":
+			entry.Link = value
+		}
+	}
+	return entries
+}
+
+// CheckPath matches rar archives by extension or signature, the first
+// volume is either a .rar file without a part number, the .part1.rar
+// file, the .001 file or a renamed or self extracting archive
+func (cmd *cmdRAR) CheckPath(path string, sig Signature) Match {
+	ext := strings.ToLower(filepath.Ext(path))
+
+	if !sig.IsRAR() {
+		// Files with another signature are not rar archives
+		// whatever their name is
+		if sig != SigNone || !cmd.ext.MatchString(ext) {
+			return MatchNone
+		}
+	}
+
+	switch {
+	case ext == ".rar":
+		if m := rarPart.FindStringSubmatch(strings.ToLower(filepath.Base(path))); m != nil {
+			if n, _ := strconv.Atoi(m[1]); n != 1 {
+				return MatchVolume
+			}
+		}
+		return MatchFirst
+	case ext == ".001", !cmd.ext.MatchString(ext):
+		return MatchFirst
+	}
+
+	return MatchVolume
 }
 
 func (cmd *cmdRAR) Installed() bool {
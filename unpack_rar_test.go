@@ -0,0 +1,52 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRARListing(t *testing.T) {
+	out := []byte(`
+UNRAR 6.24 freeware      Copyright (c) 1993-2023 Alexander Roshal
+
+Archive: test.rar
+Details: RAR 5
+
+        Name: dir
+        Type: Directory
+  Attributes: drwxr-xr-x
+
+        Name: dir/a.txt
+        Type: File
+        Size: 5
+  Attributes: -rw-r--r--
+
+        Name: dir/link
+        Type: Symbolic link
+      Target: ../../etc
+        Size: 9
+
+        Name: hard
+        Type: Hard link
+      Target: dir/a.txt
+
+        Name: copy
+        Type: File reference
+      Target: /etc/passwd
+
+        Name: name: with colon
+        Type: File
+`)
+
+	want := []Entry{
+		{Name: "dir"},
+		{Name: "dir/a.txt"},
+		{Name: "dir/link", Link: "../../etc"},
+		{Name: "hard", Link: "dir/a.txt", Hard: true},
+		{Name: "copy", Link: "/etc/passwd", Hard: true},
+		{Name: "name: with colon"},
+	}
+	if got := parseRARListing(out); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseRARListing = %+v, want %+v", got, want)
+	}
+}
@@ -9,30 +9,71 @@ import (
 )
 
 type cmdZIP struct {
-	name    string
-	command string
-	ext     *regexp.Regexp
+	name     string
+	command  string
+	ext      *regexp.Regexp
+	sandbox  *sandbox
+	priority *priority
 }
 
 func (cmd *cmdZIP) Name() string {
 	return cmd.name
 }
 
+// Exit codes of unzip
+var zipErrors = map[int]error{
+	50: ErrDiskFull,
+	51: ErrCRC,
+	81: ErrUnsupported,
+	82: ErrPassword,
+}
+
 func (cmd *cmdZIP) Unpack(ctx context.Context, src, dest string, w io.Writer) error {
 
-	tool := exec.CommandContext(ctx, cmd.command, "-o", src, "-d", dest)
-	tool.Stdout = w
-	tool.Stderr = w
+	tool := cmd.sandbox.Command(ctx, src, dest, cmd.command, "-o", src, "-d", dest)
+
+	status, out, err := runTool(ctx, tool, cmd.priority, w)
+	if err != nil {
+		return err
+	}
+
+	if status != 0 {
+		return classify(status, out, zipErrors)
+	}
+
+	return nil
+}
+
+// Test verifies the checksums of all files in the archive
+func (cmd *cmdZIP) Test(ctx context.Context, src string, w io.Writer) error {
 
-	if err := tool.Start(); err != nil {
+	tool := cmd.sandbox.Command(ctx, src, "", cmd.command, "-t", "-q", src)
+
+	status, _, err := runTool(ctx, tool, cmd.priority, w)
+	if err != nil {
 		return err
 	}
 
-	return tool.Wait()
+	if status != 0 {
+		return ErrTestFailed
+	}
+
+	return nil
+}
+
+// List returns the entries of the archive, the central directory is read
+// directly as the listings of unzip leave out the targets of links
+func (cmd *cmdZIP) List(ctx context.Context, src string) ([]Entry, error) {
+	return zipEntries(src)
 }
 
-func (cmd *cmdZIP) CheckPath(path string) (string, bool) {
-	return path, cmd.ext.MatchString(filepath.Ext(path))
+// CheckPath matches zip files by signature, and by extension
+// when the file has no other signature
+func (cmd *cmdZIP) CheckPath(path string, sig Signature) Match {
+	if sig == SigZIP || (sig == SigNone && cmd.ext.MatchString(filepath.Ext(path))) {
+		return MatchFirst
+	}
+	return MatchNone
 }
 
 func (cmd *cmdZIP) Installed() bool {
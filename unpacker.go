@@ -1,13 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
+	"syscall"
 )
 
 var (
@@ -16,39 +22,165 @@ var (
 
 	// ErrUnpackFailed ...
 	ErrUnpackFailed = errors.New("Unpacking failed")
+
+	// ErrTestFailed ...
+	ErrTestFailed = errors.New("Archive test failed")
+
+	// ErrTestUnsupported ...
+	ErrTestUnsupported = errors.New("Format has no test mode")
+
+	// ErrCRC is returned when the archive data is corrupt
+	ErrCRC = errors.New("CRC error")
+
+	// ErrMissingVolume is returned when a volume of a set is missing
+	ErrMissingVolume = errors.New("Missing volume")
+
+	// ErrPassword is returned when the archive password is wrong or missing
+	ErrPassword = errors.New("Wrong password")
+
+	// ErrDiskFull is returned when the destination ran out of space
+	ErrDiskFull = errors.New("Disk full")
+
+	// ErrUnsupported is returned for unsupported compression methods
+	ErrUnsupported = errors.New("Unsupported method")
+
+	// ErrPermission is returned when the destination is not writable
+	ErrPermission = errors.New("Permission denied")
+
+	// ErrTimeout is returned when unpacking took too long or stalled
+	ErrTimeout = errors.New("Unpacking timed out")
 )
 
+// ExitError is a typed error with the exit status of the extractor
+type ExitError struct {
+	Status int
+	Err    error
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("%s (exit status %d)", e.Err.Error(), e.Status)
+}
+
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
+
+// Names of all error types returned by errorType
+var errorTypes = []string{"security", "crc", "missing_volume", "password",
+	"disk_full", "unsupported", "permission", "timeout", "error"}
+
+// errorType returns the name of the type of an unpack error, these
+// are also the keys of the 'errors' section of the config
+func errorType(err error) string {
+	if _, ok := err.(*SecurityError); ok {
+		return "security"
+	}
+
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrCRC):
+		return "crc"
+	case errors.Is(err, ErrMissingVolume):
+		return "missing_volume"
+	case errors.Is(err, ErrPassword):
+		return "password"
+	case errors.Is(err, ErrDiskFull) || errors.Is(err, syscall.ENOSPC):
+		return "disk_full"
+	case errors.Is(err, ErrUnsupported):
+		return "unsupported"
+	case errors.Is(err, ErrPermission) || os.IsPermission(err):
+		return "permission"
+	case errors.Is(err, ErrTimeout):
+		return "timeout"
+	}
+
+	return "error"
+}
+
+// Match is the result of checking a path against a Format
+type Match int
+
+const (
+	// MatchNone means the path is not handled by the format
+	MatchNone Match = iota
+
+	// MatchVolume means the path is a following volume of a set
+	MatchVolume
+
+	// MatchFirst means the path is a single archive or the first volume of a set
+	MatchFirst
+)
+
+// Entry is a file in an archive as listed by a Format. Link is the
+// target of a symlink, or of a hardlink when Hard is set.
+type Entry struct {
+	Name string
+	Link string
+	Hard bool
+}
+
 // Format ...
 type Format interface {
+	Name() string
 	Unpack(ctx context.Context, src, dest string, w io.Writer) error
-	CheckPath(path string) (string, bool)
+	List(ctx context.Context, src string) ([]Entry, error)
+	Test(ctx context.Context, src string, w io.Writer) error
+	CheckPath(path string, sig Signature) Match
 	Installed() bool
 }
 
-// Target ...
+// Target is an archive set, path is its first volume
 type Target struct {
-	format Format
-	path   string
+	format  Format
+	path    string
+	volumes []string
 }
 
 func (t *Target) String() string {
 	return t.path
 }
 
-func getFormats() []Format {
+// Format returns the name of the format of the target
+func (t *Target) Format() string {
+	return t.format.Name()
+}
+
+// Volumes returns the paths of all volumes of the target
+func (t *Target) Volumes() []string {
+	return t.volumes
+}
+
+func getFormats(sb *sandbox, prio *priority, custom []*cmdCustom) []Format {
+	var formats []Format
+
+	// User defined formats take precedence over the built-in ones
+	for _, f := range custom {
+		formats = append(formats, f)
+	}
+
 	unpackers := [...]Format{
 		&cmdRAR{
-			name:    "rar",
-			ext:     regexp.MustCompile(`^\.(rar|r\d\d|\d\d\d)$`),
-			command: "unrar",
+			name:     "rar",
+			ext:      regexp.MustCompile(`(?i)^\.(rar|r\d\d|\d\d\d)$`),
+			command:  "unrar",
+			sandbox:  sb,
+			priority: prio,
 		},
 		&cmdZIP{
-			name:    "zip",
-			ext:     regexp.MustCompile(`^\.zip$`),
-			command: "unzip",
+			name:     "zip",
+			ext:      regexp.MustCompile(`(?i)^\.zip$`),
+			command:  "unzip",
+			sandbox:  sb,
+			priority: prio,
+		},
+		&goZIP{
+			name:     "zip",
+			ext:      regexp.MustCompile(`(?i)^\.zip$`),
+			priority: prio,
 		},
 	}
-	return unpackers[:]
+	return append(formats, unpackers[:]...)
 }
 
 func recursiveDir(path string, cb func(string) error) error {
@@ -83,11 +215,25 @@ type Unpacker struct {
 }
 
 // NewUnpacker ...
-func NewUnpacker() (*Unpacker, error) {
+func NewUnpacker(cfg *config) (*Unpacker, error) {
 	u := &Unpacker{}
-	for _, uc := range getFormats() {
+	sb := newSandbox(cfg.Sandbox)
+	prio := newPriority(&cfg.Workers)
+
+	var custom []*cmdCustom
+	for i := range cfg.Formats {
+		f, err := newCustomFormat(&cfg.Formats[i], sb, prio)
+		if err != nil {
+			return nil, err
+		}
+		custom = append(custom, f)
+	}
+
+	for _, uc := range getFormats(sb, prio, custom) {
 		if uc.Installed() {
 			u.Formats = append(u.Formats, uc)
+		} else {
+			log.Printf("[Unpacker] Format %s is not installed", uc.Name())
 		}
 	}
 
@@ -103,41 +249,131 @@ func (u *Unpacker) Empty() bool {
 	return len(u.Formats) == 0
 }
 
-// Identify ...
-func (u *Unpacker) Identify(path string) *Target {
+// Identify returns the format handling path and how it matched, using
+// both the file name and its signature. Files that qBittorrent is still
+// downloading are skipped.
+func (u *Unpacker) Identify(path string) (Format, Match) {
+	if strings.HasSuffix(path, ".!qB") {
+		return nil, MatchNone
+	}
+
+	sig := sniff(path)
 	for _, format := range u.Formats {
-		if newPath, ok := format.CheckPath(path); ok {
-			return &Target{
-				format: format,
-				path:   newPath,
-			}
+		if m := format.CheckPath(path, sig); m != MatchNone {
+			return format, m
 		}
 	}
-	return nil
+	return nil, MatchNone
+}
+
+// commonPrefix returns the length of the common prefix of a and b
+func commonPrefix(a, b string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
 }
 
-// ScanPath ...
+// ScanPath returns the archive sets found below path
 func (u *Unpacker) ScanPath(ctx context.Context, path string) ([]*Target, error) {
 
-	paths := make(map[string]*Target)
+	var targets []*Target
+	var volumes []*Target
+
 	err := recursiveDir(path, func(path string) error {
-		if target := u.Identify(path); target != nil {
-			if t := paths[target.path]; t == nil {
-				paths[target.path] = target
-			}
+		format, m := u.Identify(path)
+		switch m {
+		case MatchFirst:
+			targets = append(targets, &Target{format: format, path: path, volumes: []string{path}})
+		case MatchVolume:
+			volumes = append(volumes, &Target{format: format, path: path})
 		}
 		return ctx.Err()
 	})
 
-	var out []*Target
-	for _, v := range paths {
-		out = append(out, v)
+	// Attach each following volume to the first volume of the same
+	// format in the same directory which shares the longest name prefix
+	for _, v := range volumes {
+		var set *Target
+		best := -1
+		for _, t := range targets {
+			if t.format == v.format && filepath.Dir(t.path) == filepath.Dir(v.path) {
+				if n := commonPrefix(t.path, v.path); n > best {
+					set, best = t, n
+				}
+			}
+		}
+		if set != nil {
+			set.volumes = append(set.volumes, v.path)
+		}
+	}
+
+	return targets, err
+}
+
+// splitLines returns the non-empty lines of a tool's output
+func splitLines(out []byte) []string {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		if line := scanner.Text(); len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// Unpack checks the entries of the target, unpacks it into a staging
+// directory and verifies that nothing in it refers to a location outside
+// of the destination before it's moved into place. It returns what was
+// extracted, also when unpacking failed.
+func (t *Target) Unpack(ctx context.Context, dest string, w io.Writer) (*extracted, error) {
+	src := t.path
+
+	entries, err := t.format.List(ctx, src)
+	if err != nil {
+		return &extracted{}, err
+	}
+
+	if err := checkEntries(entries); err != nil {
+		return &extracted{}, err
 	}
 
-	return out, err
+	// Only what this target extracts is reported, files that were in the
+	// destination before are left alone
+	before, err := snapshotTree(dest)
+	if err != nil {
+		return &extracted{}, err
+	}
+
+	// The extractor only sees an empty directory, so it can't write
+	// through links that were already in the destination
+	staging, err := newStaging(dest)
+	if err != nil {
+		return &extracted{}, err
+	}
+	defer os.RemoveAll(staging)
+
+	unpackErr := t.format.Unpack(ctx, src, staging, w)
+	if unpackErr != nil && ctx.Err() != nil {
+		// Canceled or timed out, the partial output is dropped
+		return &extracted{}, unpackErr
+	}
+
+	if _, err := verifyTree(staging, treeSnapshot{}); err != nil {
+		return &extracted{}, err
+	}
+
+	err = mergeTree(staging, dest)
+	os.RemoveAll(staging)
+	if err == nil {
+		err = unpackErr
+	}
+	return before.diff(dest), err
 }
 
-// Unpack ...
-func (t *Target) Unpack(ctx context.Context, dest string, w io.Writer) error {
-	return t.format.Unpack(ctx, filepath.Dir(t.path), dest, w)
+// Test checks the integrity of the target without unpacking it
+func (t *Target) Test(ctx context.Context, w io.Writer) error {
+	return t.format.Test(ctx, t.path, w)
 }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIdentify(t *testing.T) {
+	zipped := testZIP(t)
+	tests := []struct {
+		name   string
+		data   []byte
+		format string
+		match  Match
+	}{
+		{"a.rar", testRAR5, "rar", MatchFirst},
+		{"a.part1.rar", testRAR5, "rar", MatchFirst},
+		{"a.part2.rar", testRAR5, "rar", MatchVolume},
+		{"a.r00", []byte("data"), "rar", MatchVolume},
+		{"a.001", testRAR4, "rar", MatchFirst},
+		{"a.002", []byte("data"), "rar", MatchVolume},
+		{"renamed.bin", testRAR4, "rar", MatchFirst},
+		{"sfx.exe", join(testStub, testRAR5), "rar", MatchFirst},
+		{"a.zip", zipped, "zip", MatchFirst},
+		{"a.zip", []byte("data"), "zip", MatchFirst},
+		{"a.cbz", zipped, "zip", MatchFirst},
+		{"sfx.exe", join(testStub, zipped), "zip", MatchFirst},
+
+		{"fake.rar", []byte("\x1f\x8b\x08\x00"), "", MatchNone},
+		{"fake.zip", testRAR5, "rar", MatchFirst},
+		{"setup.exe", join(testStub, []byte("PK\x03\x04Rar!\x1a\x07\x00"), testStub), "", MatchNone},
+		{"a.rar.!qB", testRAR5, "", MatchNone},
+		{"a.txt", []byte("data"), "", MatchNone},
+	}
+
+	u := &Unpacker{Formats: getFormats(nil, nil, nil)}
+	dir := t.TempDir()
+	for i, test := range tests {
+		path := filepath.Join(dir, string(rune('a'+i)))
+		if err := mkdirFile(filepath.Join(path, test.name), test.data); err != nil {
+			t.Fatal(err)
+		}
+
+		format, m := u.Identify(filepath.Join(path, test.name))
+		name := ""
+		if format != nil {
+			name = format.Name()
+		}
+		if name != test.format || m != test.match {
+			t.Errorf("Identify(%s) = %q, %d, want %q, %d", test.name, name, m, test.format, test.match)
+		}
+	}
+}
+
+func mkdirFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// progressWriter counts the bytes of tool output written through it
+type progressWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	atomic.AddInt64(&pw.n, int64(n))
+	return n, err
+}
+
+func (pw *progressWriter) Written() int64 {
+	return atomic.LoadInt64(&pw.n)
+}
+
+// dirSize returns the total size of the files below path
+func dirSize(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(name string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// watch cancels the unpack when neither the tool output nor the size
+// of the destination has grown for the stall duration
+func watch(ctx context.Context, cancel context.CancelFunc, stall time.Duration,
+	target *Target, dest string, pw *progressWriter) {
+
+	interval := stall / 4
+	if interval > time.Minute {
+		interval = time.Minute
+	} else if interval < time.Second {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastOut, lastSize := pw.Written(), dirSize(dest)
+	lastChange := time.Now()
+
+	for {
+		select {
+		case <-ticker.C:
+			out, size := pw.Written(), dirSize(dest)
+			if out > lastOut || size > lastSize {
+				lastOut, lastSize = out, size
+				lastChange = time.Now()
+			} else if time.Since(lastChange) >= stall {
+				log.Printf("[Watchdog] No progress unpacking %s for %s, stopping it", target.String(), stall)
+				cancel()
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// unpackTarget unpacks a target with the configured maximum duration and
+// stall watchdog. Both cancel the extractor and return ErrTimeout.
+func unpackTarget(ctx context.Context, cfg *config, target *Target, dest string, w io.Writer) (*extracted, error) {
+	timeout := time.Duration(cfg.Workers.Timeout) * time.Minute
+	stall := time.Duration(cfg.Workers.Stall) * time.Minute
+
+	if timeout == 0 && stall == 0 {
+		return target.Unpack(ctx, dest, w)
+	}
+
+	var tctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		tctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		tctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	pw := &progressWriter{w: w}
+	if stall > 0 {
+		go watch(tctx, cancel, stall, target, dest, pw)
+	}
+
+	ex, err := target.Unpack(tctx, dest, pw)
+	if err != nil && ctx.Err() == nil && tctx.Err() != nil {
+		return ex, ErrTimeout
+	}
+	return ex, err
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tag of queued torrents that wait for their unpack job to be allowed
+const tagWaiting = "qbd:waiting"
+
+// Short names of the days of the week, in the order of time.Weekday
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// timeWindow is a time of day on some days of the week in which unpack
+// jobs may start. A window that ends before it starts ends the next day.
+type timeWindow struct {
+	days  [7]bool
+	start int
+	end   int
+}
+
+// parseWeekday returns the day of the week of a short day name
+func parseWeekday(name string) (int, bool) {
+	for i, day := range weekdays {
+		if strings.EqualFold(name, day) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// parseClock returns the minutes since midnight of a HH:MM time
+func parseClock(clock string) (int, bool) {
+	parts := strings.Split(clock, ":")
+	if len(parts) != 2 {
+		return 0, false
+	}
+	h, err1 := strconv.Atoi(parts[0])
+	m, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, false
+	}
+	return h*60 + m, true
+}
+
+// parseWindow parses a window like "Mon-Fri 01:00-07:00", "Sat,Sun 00:00-24:00"
+// or "22:00-06:00" for every day
+func parseWindow(s string) (*timeWindow, error) {
+	invalid := fmt.Errorf("scheduler window '%s' is invalid, use for example 'Mon-Fri 01:00-07:00'", s)
+	w := &timeWindow{}
+
+	fields := strings.Fields(s)
+	switch len(fields) {
+	case 1:
+		for i := range w.days {
+			w.days[i] = true
+		}
+	case 2:
+		for _, days := range strings.Split(fields[0], ",") {
+			bounds := strings.Split(days, "-")
+			first, ok := parseWeekday(bounds[0])
+			if !ok || len(bounds) > 2 {
+				return nil, invalid
+			}
+			last := first
+			if len(bounds) == 2 {
+				if last, ok = parseWeekday(bounds[1]); !ok {
+					return nil, invalid
+				}
+			}
+			// A range like Fri-Mon wraps around the end of the week
+			for day := first; ; day = (day + 1) % 7 {
+				w.days[day] = true
+				if day == last {
+					break
+				}
+			}
+		}
+	default:
+		return nil, invalid
+	}
+
+	clocks := strings.Split(fields[len(fields)-1], "-")
+	if len(clocks) != 2 {
+		return nil, invalid
+	}
+	var ok1, ok2 bool
+	w.start, ok1 = parseClock(clocks[0])
+	w.end, ok2 = parseClock(clocks[1])
+	if !ok1 || !ok2 || w.start == w.end {
+		return nil, invalid
+	}
+	return w, nil
+}
+
+// contains returns true if t is inside the window
+func (w *timeWindow) contains(t time.Time) bool {
+	day := int(t.Weekday())
+	minute := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return w.days[day] && minute >= w.start && minute < w.end
+	}
+	// The window started the day before
+	return (w.days[day] && minute >= w.start) || (w.days[(day+6)%7] && minute < w.end)
+}
+
+// inWindows returns true if t is inside one of the windows, or if there
+// are no windows
+func inWindows(windows []*timeWindow, t time.Time) bool {
+	for _, w := range windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return len(windows) == 0
+}
+
+// deferral returns why unpack jobs can't start right now, or an empty
+// string if they can. The kind of the reason is returned separately.
+func (tm *TorrentQueue) deferral() (string, string) {
+	sched := &tm.config.Scheduler
+
+	if !inWindows(sched.windows, time.Now()) {
+		return "window", "outside the unpack windows"
+	}
+
+	if sched.MaxDownload > 0 && tm.dlRate > sched.MaxDownload {
+		return "download", fmt.Sprintf("the download rate of %d KiB/s is above %d KiB/s",
+			tm.dlRate/1024, sched.MaxDownload/1024)
+	}
+
+	if sched.MaxLoad > 0 {
+		if load, err := loadAverage(); err == nil && load > sched.MaxLoad {
+			return "load", fmt.Sprintf("the load average of %.2f is above %.2f", load, sched.MaxLoad)
+		}
+	}
+
+	return "", ""
+}
+
+// SetDownloadRate keeps the current download rate of qBittorrent, in
+// bytes per second, and starts deferred jobs when it dropped
+func (tm *TorrentQueue) SetDownloadRate(rate uint64) {
+	tm.Lock()
+	defer tm.Unlock()
+	tm.dlRate = rate
+	tm.queueA.wake()
+}
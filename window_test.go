@@ -0,0 +1,109 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseWindow(t *testing.T) {
+	tests := []struct {
+		window string
+		days   string // Sunday to Saturday
+		start  int
+		end    int
+	}{
+		{"22:00-06:00", "1111111", 22 * 60, 6 * 60},
+		{"Mon-Fri 01:00-07:30", "0111110", 60, 7*60 + 30},
+		{"Sat,Sun 00:00-24:00", "1000001", 0, 24 * 60},
+		{"fri-mon 20:00-08:00", "1100011", 20 * 60, 8 * 60},
+		{"Sun-Sat 09:00-17:00", "1111111", 9 * 60, 17 * 60},
+		{"Wed 09:00-17:00", "0001000", 9 * 60, 17 * 60},
+		{"Mon,Wed-Thu,Sat 09:00-17:00", "0101101", 9 * 60, 17 * 60},
+		{"Tue-Tue 09:00-17:00", "0010000", 9 * 60, 17 * 60},
+
+		{"", "", 0, 0},
+		{"09:00", "", 0, 0},
+		{"09:00-09:00", "", 0, 0},
+		{"09:00-24:01", "", 0, 0},
+		{"09:60-10:00", "", 0, 0},
+		{"9-17", "", 0, 0},
+		{"Mon-Fri-Sat 09:00-17:00", "", 0, 0},
+		{"Monday 09:00-17:00", "", 0, 0},
+		{"Mon- 09:00-17:00", "", 0, 0},
+		{"Mon 09:00-17:00 extra", "", 0, 0},
+	}
+
+	for _, test := range tests {
+		w, err := parseWindow(test.window)
+		if len(test.days) == 0 {
+			if err == nil {
+				t.Errorf("parseWindow(%q) succeeded, want an error", test.window)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseWindow(%q) = %v", test.window, err)
+			continue
+		}
+		days := ""
+		for _, day := range w.days {
+			if day {
+				days += "1"
+			} else {
+				days += "0"
+			}
+		}
+		if days != test.days || w.start != test.start || w.end != test.end {
+			t.Errorf("parseWindow(%q) = %s %d-%d, want %s %d-%d",
+				test.window, days, w.start, w.end, test.days, test.start, test.end)
+		}
+	}
+}
+
+func TestWindowContains(t *testing.T) {
+	// Monday the 1st of January 2024
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 1, day, hour, minute, 0, 0, time.Local)
+	}
+
+	tests := []struct {
+		window string
+		time   time.Time
+		want   bool
+	}{
+		{"Mon-Fri 01:00-07:00", at(1, 1, 0), true},
+		{"Mon-Fri 01:00-07:00", at(1, 6, 59), true},
+		{"Mon-Fri 01:00-07:00", at(1, 7, 0), false},
+		{"Mon-Fri 01:00-07:00", at(1, 0, 59), false},
+		{"Mon-Fri 01:00-07:00", at(6, 2, 0), false},
+		{"Sat,Sun 00:00-24:00", at(7, 23, 59), true},
+		{"Sat,Sun 00:00-24:00", at(8, 0, 0), false},
+
+		// Windows that end the next morning
+		{"22:00-06:00", at(1, 23, 0), true},
+		{"22:00-06:00", at(1, 5, 59), true},
+		{"22:00-06:00", at(1, 6, 0), false},
+		{"22:00-06:00", at(1, 12, 0), false},
+		{"Fri 22:00-06:00", at(5, 23, 0), true},
+		{"Fri 22:00-06:00", at(6, 3, 0), true},
+		{"Fri 22:00-06:00", at(5, 3, 0), false},
+		{"Fri 22:00-06:00", at(6, 23, 0), false},
+		{"Sun 22:00-06:00", at(1, 3, 0), true},
+		{"Fri-Mon 20:00-08:00", at(2, 7, 0), true},
+		{"Fri-Mon 20:00-08:00", at(2, 21, 0), false},
+	}
+
+	for _, test := range tests {
+		w, err := parseWindow(test.window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := w.contains(test.time); got != test.want {
+			t.Errorf("%q contains %s = %t, want %t", test.window, test.time.Format("Mon 15:04"), got, test.want)
+		}
+	}
+
+	if !inWindows(nil, at(1, 12, 0)) {
+		t.Error("no windows should allow any time")
+	}
+}